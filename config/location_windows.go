@@ -21,3 +21,38 @@ func GetRoleConfFileName() string {
 func GetFPFileName() string {
 	return "\\filepermission.conf"
 }
+
+// GetSessionConfFileName gets the file name for the session conf file
+func GetSessionConfFileName() string {
+	return "\\session.conf"
+}
+
+// GetAPIKeyConfFileName gets the file name for the api key conf file
+func GetAPIKeyConfFileName() string {
+	return "\\apikey.conf"
+}
+
+// GetCertMappingConfFileName gets the file name for the certificate mapping conf file
+func GetCertMappingConfFileName() string {
+	return "\\certmapping.conf"
+}
+
+// GetJournalFileName gets the file name for the write ahead journal
+func GetJournalFileName() string {
+	return "\\journal"
+}
+
+// GetLockFileName gets the file name for the lock file guarding writes
+func GetLockFileName() string {
+	return "\\userd.lock"
+}
+
+// GetMasterKeyFileName gets the file name for the master key file
+func GetMasterKeyFileName() string {
+	return "\\master.key"
+}
+
+// GetSettingsFileName gets the file name for the location settings file
+func GetSettingsFileName() string {
+	return "\\userd.conf"
+}
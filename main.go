@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
@@ -17,6 +18,38 @@ const (
 	nilCredentials = "<nil>"
 )
 
+// Exit statuses of userd. Usage errors and unexpected errors exit with 1,
+// invalid flags with 2.
+const (
+	exitNotFound = iota + 3
+	exitInvalid
+	exitAuthentication
+	exitAuthorization
+	exitStorage
+)
+
+// exitStatus returns the exit status for an error or message passed to
+// handleError.
+func exitStatus(msg interface{}) int {
+	err, ok := msg.(error)
+	if !ok {
+		return 1
+	}
+	switch {
+	case errors.Is(err, user.ErrNotFound):
+		return exitNotFound
+	case errors.Is(err, user.ErrInvalid), errors.Is(err, user.ErrExists):
+		return exitInvalid
+	case errors.Is(err, user.ErrBadCredentials), errors.Is(err, user.ErrAccountRefused):
+		return exitAuthentication
+	case errors.Is(err, user.ErrNotAuthorized), errors.Is(err, user.ErrPermissionExpired), errors.Is(err, user.ErrRoleMismatch):
+		return exitAuthorization
+	case errors.Is(err, user.ErrStorage):
+		return exitStorage
+	}
+	return 1
+}
+
 var op string
 var email string
 var password string
@@ -32,23 +65,66 @@ var expiration string
 var newPassword string
 var confirmPassword string
 var server string
+var target string
+var lockTimeout time.Duration
+var caBundle string
+var masterKey string
+var passwordHasher string
+var totp string
+var adminTOTP string
+var required bool
+var token string
+var sessionID string
+var account string
+var keyID string
+var resetToken string
+var identity string
+var clientAuth string
+var action string
+var parent string
+var group string
+var deny bool
+var explain bool
+
+// dir is the directory of the location.
+var dir *user.Directory
 
 func init() {
-	flag.StringVar(&op, "op", "", "Userd operation\n\t* create_user\n\t* create_role\n\t* assign_fp (assign file permissions)\n\t* list_roles (you will require the uuid when creating a user)\n\t* is_authorized (check if user is authorized to access resource/file)")
+	flag.StringVar(&op, "op", "", "Userd operation\n\t* create_user\n\t* create_role (optionally inheriting from -parent roles)\n\t* set_role_parents (set the roles a role inherits from)\n\t* assign_fp (assign file permissions to a user, role or group, -deny denies instead of granting)\n\t* list_roles (you will require the uuid when creating a user)\n\t* is_authorized (check if user is authorized to access resource/file, -explain explains the decision)\n\t* migrate (copy all data from location to target)\n\t* delete_user\n\t* revoke_fp (revoke file permissions)\n\t* add_role (let a user hold another role)\n\t* remove_role (remove a role added with add_role from a user)\n\t* add_group (add a user to a group)\n\t* remove_group (remove a user from a group)\n\t* list_user_roles (list the effective roles and the groups of a user)\n\t* compact (discard superseded and deleted records from data files)\n\t* rotate_key (re-encrypt user secrets with a new master key)\n\t* unlock_user (lift the lockout after too many failed attempts)\n\t* enroll_totp (enroll a TOTP secret as second factor, requires user credentials)\n\t* require_totp (require a second factor for a user or role)\n\t* remove_totp (remove the TOTP secret of a user)\n\t* list_sessions (list the sessions of a user, or of all users)\n\t* revoke_session (revoke a session by its id)\n\t* introspect (verify a session token and show its session)\n\t* create_service_account (create a service account which authenticates with api keys)\n\t* issue_api_key (issue an api key for a service account)\n\t* revoke_api_key (revoke an api key by its key id)\n\t* list_api_keys (list the api keys of a service account, or of all service accounts)\n\t* issue_reset_token (issue a single use token to reset the password of a user)\n\t* reset_password (set a new password with a reset token, requires the reset token instead of credentials)\n\t* disable_user (refuse a user until they are enabled again)\n\t* enable_user (enable a disabled or expired user)\n\t* expire_user (expire a user now, or at the end of -expiration)\n\t* map_cert (map a client certificate identity to a user)\n\t* unmap_cert (remove the mapping of a client certificate identity)\n\t* list_cert_mappings (list the mappings of client certificate identities to users)")
 	flag.StringVar(&email, "email", "", "User email")
 	flag.StringVar(&password, "password", "", "User password")
 	flag.StringVar(&adminEmail, "admin-email", "", "Admin email * mandatory")
 	flag.StringVar(&adminPwd, "admin-password", "", "Admin password * mandatory")
+	flag.StringVar(&totp, "totp", "", "TOTP or recovery code of the user, if they use a second factor")
+	flag.StringVar(&adminTOTP, "admin-totp", "", "TOTP or recovery code of the admin, if they use a second factor")
+	flag.StringVar(&token, "token", "", "Session token to introspect")
+	flag.StringVar(&sessionID, "session", "", "Session id to revoke")
+	flag.StringVar(&account, "account", "", "Service account name")
+	flag.StringVar(&keyID, "key-id", "", "Key id of the api key to revoke")
+	flag.StringVar(&resetToken, "reset-token", "", "Password reset token issued by an admin")
+	flag.StringVar(&identity, "identity", "", "Client certificate identity, for e.g. subject:CN=backup,O=openspock, email:backup@openspock.org, dns:backup.openspock.org or uri:spiffe://openspock.org/backup")
+	flag.StringVar(&clientAuth, "client-auth", "none", "Whether the server verifies client certificates against client-ca.crt in the location, one of none, optional or required")
+	flag.BoolVar(&deny, "deny", false, "Whether assign_fp denies the actions instead of granting them. Denies without email, role and group apply to everyone")
+	flag.BoolVar(&explain, "explain", false, "Whether is_authorized lists every file permission matching the resource with the reason it decided or did not")
+	flag.BoolVar(&required, "required", true, "Whether require_totp requires or no longer requires a second factor, for e.g. -required=false")
 	flag.StringVar(&description, "description", "", "User description - please enter a string in quotes")
 	flag.StringVar(&roleName, "role", "", "Role name")
-	flag.StringVar(&location, "location", "", "Userd location * mandatory - this is the location of your userd config and data files. By default, this is C:\\Userd in windows and /etc/userd in *nix systems")
+	flag.StringVar(&group, "group", "", "Group name, for e.g. finance")
+	flag.StringVar(&parent, "parent", "", "Comma separated names of the roles a role inherits from, for e.g. analyst")
+	flag.StringVar(&location, "location", "", "Userd location * mandatory - this is the location of your userd config and data files. By default, this is C:\\Userd in windows and /etc/userd in *nix systems. https:// locations are read-only")
 	flag.BoolVar(&help, "help", false, "Prints help")
 	flag.BoolVar(&verbose, "verbose", false, "Print verbose logging information")
-	flag.StringVar(&resource, "resource", "", "File URL to provide access to either a user email or role. If both are provided, role will be ignored.")
+	flag.StringVar(&resource, "resource", "", "File URL to provide access to either a user email, role or group. If several are provided, email wins over group and group wins over role.")
+	flag.StringVar(&action, "action", "", "Action on the resource, for e.g. read, write or a custom verb such as deploy. assign_fp takes a comma separated list and grants every action (*) by default, is_authorized checks read by default")
 	flag.StringVar(&expiration, "expiration", "", "expiration date in yyyy-MM-dd format")
 	flag.StringVar(&newPassword, "new-password", "", "New password")
 	flag.StringVar(&confirmPassword, "confirm-password", "", "Confirm password")
 	flag.StringVar(&server, "server", "", "Start server")
+	flag.DurationVar(&lockTimeout, "lock-timeout", user.LockTimeout, "How long to wait for other userd processes to release the location, for e.g. 30s")
+	flag.StringVar(&caBundle, "ca-bundle", "", "PEM encoded CA bundle to verify https locations, system roots are used by default")
+	flag.StringVar(&masterKey, "master-key", "", "Master key file to decrypt users of http(s) locations")
+	flag.StringVar(&passwordHasher, "password-hasher", "argon2id", "Algorithm to hash new and changed passwords with, one of argon2id, bcrypt or scrypt")
+	flag.StringVar(&target, "target", "", "Target location for migrate, for e.g. file:///var/lib/userd")
 }
 
 func printHelp() {
@@ -61,17 +137,26 @@ func handleError(msg interface{}) {
 	}
 	fmt.Println("####################    error    ####################")
 	fmt.Println()
-	fmt.Println(msg)
+	if err, ok := msg.(*user.PasswordPolicyError); ok {
+		fmt.Println("password does not meet the password policy, it")
+		for _, v := range err.Violations {
+			fmt.Println("  * " + v.Message)
+		}
+	} else {
+		fmt.Println(msg)
+	}
 	fmt.Println()
 	fmt.Println("#####################################################")
 	printHelp()
-	os.Exit(1)
+	os.Exit(exitStatus(msg))
 }
 
 func validateMandatory() {
 	switch op {
 	case "is_authorized":
 	case "change_password":
+	case "enroll_totp":
+	case "reset_password":
 		break
 	default:
 		if adminEmail == "" || adminPwd == "" {
@@ -81,7 +166,7 @@ func validateMandatory() {
 }
 
 func getRoleID() string {
-	roleID, err := user.GetRoleIDFor(roleName)
+	roleID, err := dir.GetRoleIDFor(roleName)
 	if err != nil {
 		handleError(err)
 	}
@@ -89,7 +174,11 @@ func getRoleID() string {
 }
 
 func getRole() user.Role {
-	return user.RoleTable[getRoleID()]
+	role, err := dir.LookupRole(getRoleID())
+	if err != nil {
+		handleError(err)
+	}
+	return role
 }
 
 func getExpirationDate() time.Time {
@@ -109,20 +198,28 @@ func handleLocation() {
 		location = config.GetDefaultLocation()
 
 		if _, err := os.Stat(location); err == nil {
-			_, err := user.NewConfig(location)
-			handleError(err)
+			openLocation()
 		}
-		if len(user.UserTable) == 0 && adminEmail == "" {
+		if (dir == nil || dir.UserCount() == 0) && adminEmail == "" {
 			adminEmail = string(nilCredentials)
 			adminPwd = string(nilCredentials)
 		}
 	}
 
-	if !strings.HasPrefix(location, "file://") {
+	if !strings.Contains(location, "://") {
 		location = "file://" + location
 	}
 }
 
+// openLocation loads the directory of the location.
+func openLocation() {
+	d, err := user.Open(location)
+	if err != nil {
+		handleError(err)
+	}
+	dir = d
+}
+
 func handleFirstTime() {
 	log.Disabled = true
 	// uninitialized userd
@@ -141,12 +238,7 @@ func handleFirstTime() {
 		}
 	}
 
-	role, err := user.CreateRole("admin", location)
-	if err != nil {
-		handleError(err)
-	}
-
-	fmt.Println("Great! We've initialized userd at this location. Next, let's setup an admin user.")
+	fmt.Println("Great! Next, let's setup an admin user.")
 	fmt.Println("We use emails as userid. Please enter an email you'd like to use as your username.")
 	fmt.Println("We promise not to send unnecessary spam! :) ")
 	fmt.Print("email: ")
@@ -154,9 +246,11 @@ func handleFirstTime() {
 	fmt.Print("password: ")
 	fmt.Scanln(&adminPwd)
 
-	if err := user.CreateUser(adminEmail, adminPwd, "Userd admin", role.RoleID, location, "init", "init"); err != nil {
+	openLocation()
+	if err := dir.Initialize(adminEmail, adminPwd); err != nil {
 		handleError(err)
 	}
+	fmt.Println("We've initialized userd at this location.")
 	fmt.Println("You're all set up and ready to go.")
 	fmt.Println()
 	fmt.Println("Please type <userd -help> to get a list of options.")
@@ -175,31 +269,68 @@ func createUser() {
 
 	roleID := getRoleID()
 
-	if err := user.CreateUser(email, password, description, roleID, location, adminEmail, adminPwd); err != nil {
+	if err := dir.CreateUser(email, password, description, roleID); err != nil {
 		handleError(err)
 	}
 
 	fmt.Println("User created successfully!")
 }
 
+// getParentIDs returns the RoleIDs of the roles named in -parent.
+func getParentIDs() []string {
+	var parents []string
+	for _, name := range strings.Split(parent, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		roleID, err := dir.GetRoleIDFor(name)
+		if err != nil {
+			handleError(err)
+		}
+		parents = append(parents, roleID)
+	}
+	return parents
+}
+
 func createRole() {
 	if roleName == "" {
 		handleError("roleName is required")
 	}
-	role, err := user.CreateRole(roleName, location)
+	role, err := dir.CreateRole(roleName, getParentIDs()...)
 	if err != nil {
 		handleError(err)
 	}
 	fmt.Println("Role " + roleName + " created successfully with id: " + role.RoleID)
 }
 
+func setRoleParents() {
+	if roleName == "" {
+		handleError("role is required")
+	}
+	if err := dir.SetRoleParents(getRoleID(), getParentIDs()); err != nil {
+		handleError(err)
+	}
+	fmt.Println("Parents of role " + roleName + " set successfully!")
+}
+
 func listRoles() {
 	if log.Disabled {
-		for _, v := range user.ListRoles() {
-			fmt.Printf("%s : %s \n", v.(user.Role).RoleID, v.(user.Role).Name)
+		for _, v := range dir.ListRoles() {
+			r := v.(user.Role)
+			var parents []string
+			for _, p := range r.Parents {
+				if pr, ok := dir.Role(p); ok {
+					parents = append(parents, pr.Name)
+				}
+			}
+			if len(parents) > 0 {
+				fmt.Printf("%s : %s (inherits from %s)\n", r.RoleID, r.Name, strings.Join(parents, ", "))
+			} else {
+				fmt.Printf("%s : %s \n", r.RoleID, r.Name)
+			}
 		}
 	}
-	log.Info("All available roles", log.AppMsg, user.ListRoles())
+	log.Info("All available roles", log.AppMsg, dir.ListRoles())
 }
 
 func assignFP() {
@@ -207,27 +338,405 @@ func assignFP() {
 		handleError("resource is required")
 	}
 
-	if email == "" && roleName == "" {
-		handleError("Either email or role name is required")
+	if email == "" && roleName == "" && group == "" && !deny {
+		handleError("Either email, role name or group is required")
+	}
+
+	var u user.User
+	if email != "" {
+		var err error
+		if u, err = dir.LookupUser(email); err != nil {
+			handleError(err)
+		}
+	}
+
+	if action == "" {
+		action = user.AnyAction
+	}
+	actions, err := user.ParseActions(action)
+	if err != nil {
+		handleError(err)
+	}
+
+	if email == "" && group != "" {
+		createGroupFP := dir.CreateGroupFP
+		if deny {
+			createGroupFP = dir.DenyGroupFP
+		}
+		if _, err := createGroupFP(resource, group, actions, getExpirationDate()); err != nil {
+			handleError(err)
+		}
+		return
+	}
+
+	var role user.Role
+	if email == "" && roleName != "" {
+		role = getRole()
+	}
+
+	createFP := dir.CreateFP
+	if deny {
+		createFP = dir.DenyFP
+	}
+	if _, err := createFP(resource, &u, &role, actions, getExpirationDate()); err != nil {
+		handleError(err)
+	}
+}
+
+func revokeFP() {
+	if resource == "" {
+		handleError("resource is required")
+	}
+
+	if email == "" && roleName == "" && group == "" && !deny {
+		handleError("Either email, role name or group is required")
+	}
+
+	if email == "" && group != "" {
+		if err := dir.RevokeGroupFP(resource, group); err != nil {
+			handleError(err)
+		}
+		fmt.Println("Permission for " + resource + " revoked successfully!")
+		return
 	}
 
 	var u user.User
-	var ok bool
 	if email != "" {
-		u, ok = user.UserTable[email]
-		if !ok {
-			handleError(email + " does not exist")
+		var err error
+		if u, err = dir.LookupUser(email); err != nil {
+			handleError(err)
 		}
 	}
 
 	var role user.Role
-	if email == "" {
+	if email == "" && roleName != "" {
 		role = getRole()
 	}
 
-	if _, err := user.CreateFP(resource, &u, &role, getExpirationDate(), location); err != nil {
+	if err := dir.RevokeFP(resource, &u, &role); err != nil {
+		handleError(err)
+	}
+	fmt.Println("Permission for " + resource + " revoked successfully!")
+}
+
+func addRole() {
+	if email == "" || roleName == "" {
+		handleError("email and role are required")
+	}
+
+	if err := dir.AddUserRole(email, getRoleID()); err != nil {
+		handleError(err)
+	}
+	fmt.Println("Role " + roleName + " added to " + email + " successfully!")
+}
+
+func removeRole() {
+	if email == "" || roleName == "" {
+		handleError("email and role are required")
+	}
+
+	if err := dir.RemoveUserRole(email, getRoleID()); err != nil {
+		handleError(err)
+	}
+	fmt.Println("Role " + roleName + " removed from " + email + " successfully!")
+}
+
+func addGroup() {
+	if email == "" || group == "" {
+		handleError("email and group are required")
+	}
+
+	if err := dir.AddUserToGroup(email, group); err != nil {
+		handleError(err)
+	}
+	fmt.Println(email + " added to group " + group + " successfully!")
+}
+
+func removeGroup() {
+	if email == "" || group == "" {
+		handleError("email and group are required")
+	}
+
+	if err := dir.RemoveUserFromGroup(email, group); err != nil {
+		handleError(err)
+	}
+	fmt.Println(email + " removed from group " + group + " successfully!")
+}
+
+func listUserRoles() {
+	if email == "" {
+		handleError("email is required")
+	}
+
+	roles, err := dir.EffectiveRoles(email)
+	if err != nil {
+		handleError(err)
+	}
+	u, err := dir.LookupUser(email)
+	if err != nil {
+		handleError(err)
+	}
+	for _, r := range roles {
+		fmt.Printf("role %s : %s\n", r.RoleID, r.Name)
+	}
+	for _, g := range u.Groups {
+		fmt.Println("group " + g)
+	}
+}
+
+func deleteUser() {
+	if email == "" && account == "" {
+		handleError("Either email or account is required")
+	}
+
+	name := email
+	if name == "" {
+		name = account
+	}
+	if err := dir.DeleteUser(name); err != nil {
+		handleError(err)
+	}
+	fmt.Println("User " + name + " deleted successfully!")
+}
+
+func compact() {
+	if err := dir.Compact(); err != nil {
+		handleError(err)
+	}
+	fmt.Println("Compacted " + location + " successfully!")
+}
+
+func rotateKey() {
+	if err := dir.RotateKey(); err != nil {
+		handleError(err)
+	}
+	fmt.Println("Rotated master key of " + location + " successfully!")
+}
+
+func disableUser() {
+	if email == "" {
+		handleError("email is required")
+	}
+
+	if err := dir.DisableUser(email); err != nil {
+		handleError(err)
+	}
+	fmt.Println("User " + email + " disabled successfully!")
+}
+
+func enableUser() {
+	if email == "" {
+		handleError("email is required")
+	}
+
+	if err := dir.EnableUser(email); err != nil {
+		handleError(err)
+	}
+	fmt.Println("User " + email + " enabled successfully!")
+}
+
+func expireUser() {
+	if email == "" {
+		handleError("email is required")
+	}
+
+	if expiration == "" {
+		if err := dir.ExpireUser(email); err != nil {
+			handleError(err)
+		}
+		fmt.Println("User " + email + " expired successfully!")
+		return
+	}
+	expires := getExpirationDate()
+	if err := dir.SetUserExpiry(email, expires); err != nil {
 		handleError(err)
 	}
+	fmt.Println("User " + email + " expires " + expires.Format(time.RFC3339))
+}
+
+func unlockUser() {
+	if email == "" {
+		handleError("email is required")
+	}
+
+	if err := dir.UnlockUser(email); err != nil {
+		handleError(err)
+	}
+	fmt.Println("User " + email + " unlocked successfully!")
+}
+
+func enrollTOTP() {
+	if email == "" || password == "" {
+		handleError("email and password are required")
+	}
+
+	uri, codes, err := dir.EnrollTOTP(email, password, totp)
+	if err != nil {
+		handleError(err)
+	}
+	fmt.Println("TOTP secret enrolled successfully! Add it to your authenticator app, for e.g. by scanning a QR code of")
+	fmt.Println()
+	fmt.Println("  " + uri)
+	fmt.Println()
+	fmt.Println("Keep these recovery codes in a safe place. Each of them can be used once instead of a TOTP code.")
+	fmt.Println()
+	for _, code := range codes {
+		fmt.Println("  " + code)
+	}
+}
+
+func requireTOTP() {
+	if email == "" && roleName == "" {
+		handleError("Either email or role name is required")
+	}
+
+	if email != "" {
+		if err := dir.RequireUserTOTP(email, required); err != nil {
+			handleError(err)
+		}
+		fmt.Printf("Second factor required for %s: %t\n", email, required)
+		return
+	}
+	if err := dir.RequireRoleTOTP(getRoleID(), required); err != nil {
+		handleError(err)
+	}
+	fmt.Printf("Second factor required for role %s: %t\n", roleName, required)
+}
+
+func removeTOTP() {
+	if email == "" {
+		handleError("email is required")
+	}
+
+	if err := dir.RemoveTOTP(email); err != nil {
+		handleError(err)
+	}
+	fmt.Println("TOTP secret of " + email + " removed successfully!")
+}
+
+func createServiceAccount() {
+	if account == "" {
+		handleError("account is required")
+	}
+	if description == "" {
+		handleError("A description for this service account is required")
+	}
+
+	if err := dir.CreateServiceAccount(account, description, getRoleID()); err != nil {
+		handleError(err)
+	}
+	fmt.Println("Service account " + account + " created successfully!")
+}
+
+func issueAPIKey() {
+	if account == "" {
+		handleError("account is required")
+	}
+
+	// api keys without an expiration never expire
+	var expires time.Time
+	if expiration != "" {
+		expires = getExpirationDate()
+	}
+	key, k, err := dir.IssueAPIKey(account, description, expires)
+	if err != nil {
+		handleError(err)
+	}
+	fmt.Println("API key " + k.KeyID + " issued successfully! It is shown only once, keep it in a safe place.")
+	fmt.Println()
+	fmt.Println("  " + key)
+}
+
+func revokeAPIKey() {
+	if keyID == "" {
+		handleError("key-id is required")
+	}
+
+	if err := dir.RevokeAPIKey(keyID); err != nil {
+		handleError(err)
+	}
+	fmt.Println("API key " + keyID + " revoked successfully!")
+}
+
+func listAPIKeys() {
+	for _, k := range dir.ListAPIKeys(account) {
+		expires, lastUsed := "never", "never"
+		if !k.Expires.IsZero() {
+			expires = k.Expires.Format(time.RFC3339)
+		}
+		if !k.LastUsed.IsZero() {
+			lastUsed = k.LastUsed.Format(time.RFC3339)
+		}
+		fmt.Printf("%s : %s %q, created %s, expires %s, last used %s\n", k.KeyID, k.Account, k.Description, k.Created.Format(time.RFC3339), expires, lastUsed)
+	}
+}
+
+func mapCert() {
+	if identity == "" {
+		handleError("identity is required")
+	}
+	if email == "" && account == "" {
+		handleError("Either email or account is required")
+	}
+
+	name := email
+	if name == "" {
+		name = account
+	}
+	if err := dir.MapCertificate(identity, name); err != nil {
+		handleError(err)
+	}
+	fmt.Println("Certificate identity " + identity + " mapped to " + name + " successfully!")
+}
+
+func unmapCert() {
+	if identity == "" {
+		handleError("identity is required")
+	}
+
+	if err := dir.UnmapCertificate(identity); err != nil {
+		handleError(err)
+	}
+	fmt.Println("Certificate identity " + identity + " unmapped successfully!")
+}
+
+func listCertMappings() {
+	for _, m := range dir.ListCertificateMappings() {
+		fmt.Println(m.Identity + " : " + m.Email)
+	}
+}
+
+func printSession(s user.Session) {
+	fmt.Printf("%s : %s from %q, issued %s, expires %s\n", s.SessionID, s.Email, s.Source, s.Issued.Format(time.RFC3339), s.Expires.Format(time.RFC3339))
+}
+
+func listSessions() {
+	for _, s := range dir.ListSessions(email) {
+		printSession(s)
+	}
+}
+
+func revokeSession() {
+	if sessionID == "" {
+		handleError("session is required")
+	}
+
+	if err := dir.RevokeSession(sessionID); err != nil {
+		handleError(err)
+	}
+	fmt.Println("Session " + sessionID + " revoked successfully!")
+}
+
+func introspect() {
+	if token == "" {
+		handleError("token is required")
+	}
+
+	s, err := dir.Introspect(token)
+	if err != nil {
+		handleError(err)
+	}
+	printSession(s)
 }
 
 func isAuthorized() {
@@ -239,7 +748,46 @@ func isAuthorized() {
 		handleError("resource is required")
 	}
 
-	if err := user.Authorize(email, password, location, resource); err != nil {
+	if action == "" {
+		action = user.ActionRead
+	}
+
+	if explain {
+		explainAuthorization()
+		return
+	}
+
+	if err := dir.Authorize(email, password, totp, resource, action); err != nil {
+		handleError(err)
+	}
+}
+
+// explainAuthorization authenticates the user and prints why they are
+// authorized or not, decisive file permissions are marked with a *. Like the
+// server, it leaves out file permissions of roles the user does not hold.
+func explainAuthorization() {
+	if err := dir.Authenticate(email, password, totp); err != nil {
+		handleError(err)
+	}
+
+	e, err := dir.Explain(email, resource, action)
+	e = e.Redacted()
+	verdict := "allowed"
+	if !e.Allowed {
+		verdict = "not allowed"
+	}
+	fmt.Printf("%s %s on %s for %s\n", action, verdict, resource, email)
+	for _, g := range e.Grants {
+		mark, effect := " ", "grants"
+		if g.Decisive {
+			mark = "*"
+		}
+		if g.Deny {
+			effect = "denies"
+		}
+		fmt.Printf("%s %s %s %s to %s until %s: %s\n", mark, g.File, effect, strings.Join(g.Actions, ","), g.Grantee, g.Expiration.Format(time.RFC3339), g.Reason)
+	}
+	if err != nil {
 		handleError(err)
 	}
 }
@@ -253,7 +801,53 @@ func changePassword() {
 		handleError("new-password and confirm-password are required")
 	}
 
-	user.ChangePassword(email, password, newPassword, confirmPassword, location)
+	if err := dir.ChangePassword(email, password, totp, newPassword, confirmPassword); err != nil {
+		handleError(err)
+	}
+	fmt.Println("Password changed successfully!")
+}
+
+func issueResetToken() {
+	if email == "" {
+		handleError("email is required")
+	}
+
+	token, expires, err := dir.IssueResetToken(email)
+	if err != nil {
+		handleError(err)
+	}
+	fmt.Println("Reset token issued successfully! Hand it to " + email + ", it can be used once until " + expires.Format(time.RFC3339) + ".")
+	fmt.Println()
+	fmt.Println("  " + token)
+}
+
+func resetPassword() {
+	if email == "" || resetToken == "" {
+		handleError("email and reset-token are required")
+	}
+
+	if newPassword == "" || confirmPassword == "" {
+		handleError("new-password and confirm-password are required")
+	}
+
+	if err := dir.ResetPassword(email, resetToken, newPassword, confirmPassword); err != nil {
+		handleError(err)
+	}
+	fmt.Println("Password reset successfully!")
+}
+
+func migrate() {
+	if target == "" {
+		handleError("target is required")
+	}
+	if !strings.Contains(target, "://") {
+		target = "file://" + target
+	}
+
+	if err := dir.MigrateTo(target); err != nil {
+		handleError(err)
+	}
+	fmt.Println("Migrated " + location + " to " + target + " successfully!")
 }
 
 func startServer() {
@@ -267,15 +861,11 @@ func startServer() {
 		handleError("location is required")
 	}
 
-	if err := user.AuthenticateForRole(adminEmail, adminPwd, location, user.Admin); err != nil {
+	if err := dir.AuthenticateForRole(adminEmail, adminPwd, adminTOTP, user.Admin); err != nil {
 		handleError(err)
 	}
 
-	c, err := user.NewConfig(location)
-	if err != nil {
-		handleError(err)
-	}
-	if err := net.Listen("9669", c.Location, location); err != nil {
+	if err := net.Listen("9669", dir.Config().Location, dir); err != nil {
 		handleError(err)
 	}
 }
@@ -289,6 +879,8 @@ func handleOp() {
 	switch op {
 	case "create_role":
 		createRole()
+	case "set_role_parents":
+		setRoleParents()
 	case "create_user":
 		createUser()
 	case "list_roles":
@@ -299,6 +891,64 @@ func handleOp() {
 		isAuthorized()
 	case "change_password":
 		changePassword()
+	case "migrate":
+		migrate()
+	case "delete_user":
+		deleteUser()
+	case "revoke_fp":
+		revokeFP()
+	case "add_role":
+		addRole()
+	case "remove_role":
+		removeRole()
+	case "add_group":
+		addGroup()
+	case "remove_group":
+		removeGroup()
+	case "list_user_roles":
+		listUserRoles()
+	case "compact":
+		compact()
+	case "rotate_key":
+		rotateKey()
+	case "unlock_user":
+		unlockUser()
+	case "disable_user":
+		disableUser()
+	case "enable_user":
+		enableUser()
+	case "expire_user":
+		expireUser()
+	case "enroll_totp":
+		enrollTOTP()
+	case "require_totp":
+		requireTOTP()
+	case "remove_totp":
+		removeTOTP()
+	case "list_sessions":
+		listSessions()
+	case "revoke_session":
+		revokeSession()
+	case "introspect":
+		introspect()
+	case "create_service_account":
+		createServiceAccount()
+	case "issue_api_key":
+		issueAPIKey()
+	case "revoke_api_key":
+		revokeAPIKey()
+	case "list_api_keys":
+		listAPIKeys()
+	case "map_cert":
+		mapCert()
+	case "unmap_cert":
+		unmapCert()
+	case "list_cert_mappings":
+		listCertMappings()
+	case "issue_reset_token":
+		issueResetToken()
+	case "reset_password":
+		resetPassword()
 	case "server":
 		startServer()
 	default:
@@ -319,6 +969,18 @@ func parse() {
 		log.Disabled = true
 	}
 
+	user.LockTimeout = lockTimeout
+	user.HTTPCABundle = caBundle
+	user.HTTPMasterKeyFile = masterKey
+	hasher, err := user.NewHasher(passwordHasher)
+	if err != nil {
+		handleError(err)
+	}
+	user.Hasher = hasher
+	if net.ClientAuth, err = net.ParseClientAuth(clientAuth); err != nil {
+		handleError(err)
+	}
+
 	handleLocation()
 
 	validateMandatory()
@@ -330,14 +992,18 @@ func main() {
 	if adminEmail == nilCredentials {
 		handleFirstTime()
 	} else {
+		openLocation()
+
 		// authenticate admin
 
 		switch op {
 		case "change_password":
 		case "is_authorized":
+		case "enroll_totp":
+		case "reset_password":
 			break
 		default:
-			if err := user.AuthenticateForRole(adminEmail, adminPwd, location, user.Admin); err != nil {
+			if err := dir.AuthenticateForRole(adminEmail, adminPwd, adminTOTP, user.Admin); err != nil {
 				handleError(err)
 			}
 		}
@@ -0,0 +1,154 @@
+package net
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/openspock/log"
+)
+
+// ClientAuth is whether the server verifies client certificates, one of
+// tls.NoClientCert, tls.VerifyClientCertIfGiven or
+// tls.RequireAndVerifyClientCert. Client certificates are verified against
+// client-ca.crt in the location and checked against client.crl if it exists.
+var ClientAuth = tls.NoClientCert
+
+// ParseClientAuth parses the client authentication mode of the server, one
+// of none, optional or required.
+func ParseClientAuth(mode string) (tls.ClientAuthType, error) {
+	switch mode {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "optional":
+		return tls.VerifyClientCertIfGiven, nil
+	case "required":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, errors.New("client auth has to be one of none, optional or required, got " + mode)
+}
+
+// clientAuthConfig sets up verification of client certificates on config.
+func clientAuthConfig(config *tls.Config, certLocation string) error {
+	config.ClientAuth = ClientAuth
+	if ClientAuth == tls.NoClientCert {
+		return nil
+	}
+
+	pool := x509.NewCertPool()
+	data, err := ioutil.ReadFile(certLocation + "/client-ca.crt")
+	if err != nil {
+		return err
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return errors.New("no certificates found in " + certLocation + "/client-ca.crt")
+	}
+	config.ClientCAs = pool
+
+	crl := &revocationList{name: certLocation + "/client.crl"}
+	config.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+		return crl.check(chains)
+	}
+	return nil
+}
+
+// revocationList holds the CRLs of client.crl, one per CA, which are read
+// again whenever the file changes.
+type revocationList struct {
+	name string
+
+	mu      sync.Mutex
+	modTime time.Time
+	crls    []*x509.RevocationList
+}
+
+// check returns an error if a certificate of any verified chain, other than
+// its root, has been revoked. A certificate is checked against the CRLs
+// issued by the next certificate of the chain. Such a CRL which isn't signed
+// by that certificate or is out of date fails the check, the revocation of
+// the certificate can't be ruled out. Without a CRL file no certificate is
+// revoked.
+func (l *revocationList) check(chains [][]*x509.Certificate) error {
+	crls, err := l.load()
+	if err != nil {
+		log.Error(err.Error(), log.SysLog, map[string]interface{}{})
+		return err
+	}
+	for _, chain := range chains {
+		for i := 0; i+1 < len(chain); i++ {
+			if err := l.checkCertificate(crls, chain[i], chain[i+1]); err != nil {
+				log.Error(err.Error(), log.SysLog, map[string]interface{}{})
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkCertificate checks cert against the CRLs of its issuer.
+func (l *revocationList) checkCertificate(crls []*x509.RevocationList, cert, issuer *x509.Certificate) error {
+	for _, crl := range crls {
+		if !bytes.Equal(crl.RawIssuer, issuer.RawSubject) {
+			continue
+		}
+		if err := crl.CheckSignatureFrom(issuer); err != nil {
+			return errors.New(l.name + ": CRL of " + issuer.Subject.String() + " is invalid: " + err.Error())
+		}
+		if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+			return errors.New(l.name + ": CRL of " + issuer.Subject.String() + " is out of date, next update was due " + crl.NextUpdate.Format(time.RFC3339))
+		}
+		for _, revoked := range crl.RevokedCertificateEntries {
+			if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return errors.New("certificate " + cert.Subject.String() + " has been revoked")
+			}
+		}
+	}
+	return nil
+}
+
+// load reads the CRLs, a DER encoded one or any number of PEM encoded ones,
+// if their file changed since it was last read.
+func (l *revocationList) load() ([]*x509.RevocationList, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	info, err := os.Stat(l.name)
+	if os.IsNotExist(err) {
+		l.crls, l.modTime = nil, time.Time{}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if l.crls != nil && info.ModTime().Equal(l.modTime) {
+		return l.crls, nil
+	}
+
+	data, err := ioutil.ReadFile(l.name)
+	if err != nil {
+		return nil, err
+	}
+	var ders [][]byte
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		ders = append(ders, block.Bytes)
+	}
+	if ders == nil {
+		ders = [][]byte{data}
+	}
+	crls := make([]*x509.RevocationList, 0, len(ders))
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return nil, errors.New(l.name + ": " + err.Error())
+		}
+		crls = append(crls, crl)
+	}
+	l.crls, l.modTime = crls, info.ModTime()
+	return crls, nil
+}
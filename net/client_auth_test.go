@@ -0,0 +1,258 @@
+package net
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a generated certificate with its key.
+type testCert struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+var serial int64
+
+// newTestCert issues a certificate for name, a CA if ca is set, signed by
+// issuer or self-signed if issuer is nil.
+func newTestCert(t *testing.T, name string, ca bool, issuer *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial++
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  ca,
+	}
+	if ca {
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	} else {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	parent, signer := template, crypto.Signer(key)
+	if issuer != nil {
+		parent, signer = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+// newTestCRL returns the DER encoded CRL of issuer revoking revoked, signed
+// by signer.
+func newTestCRL(t *testing.T, issuer *testCert, signer crypto.Signer, nextUpdate time.Time, revoked ...*testCert) []byte {
+	t.Helper()
+	template := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: nextUpdate,
+	}
+	for _, c := range revoked {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   c.cert.SerialNumber,
+			RevocationTime: time.Now().Add(-time.Minute),
+		})
+	}
+	// the issuer is copied with the public key of signer, so that a CRL can
+	// be signed by another key in the name of issuer
+	cert := *issuer.cert
+	cert.PublicKey = signer.Public()
+	der, err := x509.CreateRevocationList(rand.Reader, template, &cert, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func pemCRL(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+// chains verifies leaf against root through intermediate, as the TLS
+// handshake does before VerifyPeerCertificate is called.
+func chains(t *testing.T, root, intermediate, leaf *testCert) [][]*x509.Certificate {
+	t.Helper()
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	roots.AddCert(root.cert)
+	intermediates.AddCert(intermediate.cert)
+	chains, err := leaf.cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chains
+}
+
+func TestRevocationList(t *testing.T) {
+	root := newTestCert(t, "root", true, nil)
+	intermediate := newTestCert(t, "intermediate", true, root)
+	leaf := newTestCert(t, "leaf", false, intermediate)
+	other := newTestCert(t, "other", true, nil)
+	forger, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name string
+		crl  []byte
+		err  string
+	}{
+		{"no revocations", pemCRL(newTestCRL(t, intermediate, intermediate.key, next)), ""},
+		{"revoked leaf in DER", newTestCRL(t, intermediate, intermediate.key, next, leaf), "has been revoked"},
+		{"revoked leaf in PEM", pemCRL(newTestCRL(t, intermediate, intermediate.key, next, leaf)), "has been revoked"},
+		{"revoked intermediate", append(
+			pemCRL(newTestCRL(t, intermediate, intermediate.key, next)),
+			pemCRL(newTestCRL(t, root, root.key, next, intermediate))...,
+		), "has been revoked"},
+		{"CRL of another CA", pemCRL(newTestCRL(t, other, other.key, next, leaf)), ""},
+		{"stale CRL", pemCRL(newTestCRL(t, intermediate, intermediate.key, time.Now().Add(-time.Minute))), "out of date"},
+		{"forged CRL", pemCRL(newTestCRL(t, intermediate, forger, next)), "is invalid"},
+		{"garbage", []byte("not a CRL"), "client.crl"},
+	}
+	for _, test := range tests {
+		name := filepath.Join(t.TempDir(), "client.crl")
+		if err := ioutil.WriteFile(name, test.crl, 0600); err != nil {
+			t.Fatal(err)
+		}
+		l := &revocationList{name: name}
+		err := l.check(chains(t, root, intermediate, leaf))
+		if test.err == "" && err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestRevocationListIsReloaded(t *testing.T) {
+	root := newTestCert(t, "root", true, nil)
+	intermediate := newTestCert(t, "intermediate", true, root)
+	leaf := newTestCert(t, "leaf", false, intermediate)
+	next := time.Now().Add(time.Hour)
+
+	l := &revocationList{name: filepath.Join(t.TempDir(), "client.crl")}
+	if err := l.check(chains(t, root, intermediate, leaf)); err != nil {
+		t.Errorf("without a CRL file no certificate should be revoked, got %v", err)
+	}
+	if err := ioutil.WriteFile(l.name, pemCRL(newTestCRL(t, intermediate, intermediate.key, next)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.check(chains(t, root, intermediate, leaf)); err != nil {
+		t.Error(err)
+	}
+	if err := ioutil.WriteFile(l.name, pemCRL(newTestCRL(t, intermediate, intermediate.key, next, leaf)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// the modification time might not have changed within its resolution
+	modTime := time.Now().Add(time.Minute)
+	if err := os.Chtimes(l.name, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.check(chains(t, root, intermediate, leaf)); err == nil {
+		t.Error("the revocation should be picked up once the CRL file changed")
+	}
+}
+
+func TestParseClientAuth(t *testing.T) {
+	tests := map[string]tls.ClientAuthType{
+		"":         tls.NoClientCert,
+		"none":     tls.NoClientCert,
+		"optional": tls.VerifyClientCertIfGiven,
+		"required": tls.RequireAndVerifyClientCert,
+	}
+	for mode, expected := range tests {
+		auth, err := ParseClientAuth(mode)
+		if err != nil || auth != expected {
+			t.Errorf("%q: expected %v, got %v, %v", mode, expected, auth, err)
+		}
+	}
+	if _, err := ParseClientAuth("always"); err == nil {
+		t.Error("unknown modes should be rejected")
+	}
+}
+
+func TestClientAuthConfig(t *testing.T) {
+	defer func(auth tls.ClientAuthType) { ClientAuth = auth }(ClientAuth)
+	root := newTestCert(t, "root", true, nil)
+	intermediate := newTestCert(t, "intermediate", true, root)
+	leaf := newTestCert(t, "leaf", false, intermediate)
+
+	dir := t.TempDir()
+	ClientAuth = tls.NoClientCert
+	config := &tls.Config{}
+	if err := clientAuthConfig(config, dir); err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientAuth != tls.NoClientCert || config.ClientCAs != nil || config.VerifyPeerCertificate != nil {
+		t.Error("without client auth no client CA should be needed or set up")
+	}
+
+	for _, auth := range []tls.ClientAuthType{tls.VerifyClientCertIfGiven, tls.RequireAndVerifyClientCert} {
+		ClientAuth = auth
+		dir := t.TempDir()
+		if err := clientAuthConfig(&tls.Config{}, dir); err == nil {
+			t.Errorf("%v: a missing client-ca.crt should be an error", auth)
+		}
+		if err := ioutil.WriteFile(dir+"/client-ca.crt", []byte("no certificate"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := clientAuthConfig(&tls.Config{}, dir); err == nil {
+			t.Errorf("%v: a client-ca.crt without certificates should be an error", auth)
+		}
+
+		ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.cert.Raw})
+		if err := ioutil.WriteFile(dir+"/client-ca.crt", ca, 0600); err != nil {
+			t.Fatal(err)
+		}
+		config := &tls.Config{}
+		if err := clientAuthConfig(config, dir); err != nil {
+			t.Fatal(err)
+		}
+		if config.ClientAuth != auth || config.ClientCAs == nil || config.VerifyPeerCertificate == nil {
+			t.Errorf("%v: client certificates should be verified against client-ca.crt", auth)
+			continue
+		}
+		if err := config.VerifyPeerCertificate(nil, chains(t, root, intermediate, leaf)); err != nil {
+			t.Errorf("%v: %v", auth, err)
+		}
+		crl := newTestCRL(t, intermediate, intermediate.key, time.Now().Add(time.Hour), leaf)
+		if err := ioutil.WriteFile(dir+"/client.crl", crl, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := config.VerifyPeerCertificate(nil, chains(t, root, intermediate, leaf)); err == nil {
+			t.Errorf("%v: certificates revoked in client.crl should be rejected", auth)
+		}
+	}
+}
@@ -5,20 +5,41 @@ package net
 import (
 	"bufio"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"net"
+	"time"
 
 	log "github.com/openspock/log"
 	"github.com/openspock/userd/user"
 )
 
 // Command encapsulates all properties required by the tls server to execute an operation.
-// Currently, command will only support authorization and authentication.
+// Currently, command will only support authentication, authorization, changing and resetting passwords.
+// Clients with a verified certificate mapped to a user may leave out their credentials for is_authorized.
 type Command struct {
-	Op       string `json:"op"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
-	Resource string `json:"resource"`
+	Op          string `json:"op"`
+	Email       string `json:"email"`
+	Password    string `json:"password"`
+	Resource    string `json:"resource"`
+	NewPassword string `json:"new_password,omitempty"`
+	// Action is the action is_authorized checks on the resource, for e.g.
+	// write or deploy, read by default.
+	Action string `json:"action,omitempty"`
+	// TOTP is the TOTP or recovery code of users who use a second factor.
+	TOTP string `json:"totp,omitempty"`
+	// Token is a token returned by the authenticate op, is_authorized accepts
+	// it instead of the email and password.
+	Token string `json:"token,omitempty"`
+	// APIKey is the API key of a service account, is_authorized accepts it
+	// instead of the email and password.
+	APIKey string `json:"api_key,omitempty"`
+	// ResetToken is a password reset token issued by an admin, reset_password
+	// accepts it instead of the password.
+	ResetToken string `json:"reset_token,omitempty"`
+	// Explain makes is_authorized explain its decision, see user.Explain.
+	Explain bool `json:"explain,omitempty"`
 }
 
 func (c Command) String() string {
@@ -29,6 +50,13 @@ func (c Command) String() string {
 	return string(data)
 }
 
+// redacted returns a copy of the command without credentials, for e.g. to
+// log it.
+func (c Command) redacted() Command {
+	c.Password, c.NewPassword, c.TOTP, c.APIKey, c.Token, c.ResetToken = "", "", "", "", "", ""
+	return c
+}
+
 // ExitCode indicates the type of response for a command (op) execution.
 type ExitCode int
 
@@ -41,14 +69,40 @@ const (
 	AuthorizationFailure
 	// SystemError indicates an unexpected error on the server.
 	SystemError
+	// InvalidRequest indicates that the command is invalid, for e.g. a new
+	// password which breaks the password policy.
+	InvalidRequest
 )
 
+// ExitCodeOf returns the ExitCode for an error of the user package.
+func ExitCodeOf(err error) ExitCode {
+	switch {
+	case err == nil:
+		return Success
+	case errors.Is(err, user.ErrNotFound), errors.Is(err, user.ErrBadCredentials), errors.Is(err, user.ErrAccountRefused):
+		return AuthenticationFailure
+	case errors.Is(err, user.ErrNotAuthorized), errors.Is(err, user.ErrPermissionExpired), errors.Is(err, user.ErrRoleMismatch):
+		return AuthorizationFailure
+	case errors.Is(err, user.ErrInvalid), errors.Is(err, user.ErrExists):
+		return InvalidRequest
+	}
+	return SystemError
+}
+
 // Response is sent in response to an execution of a command on the server.
 //
 //
 type Response struct {
 	Code    ExitCode
 	Message string
+	// Violations lists the rules of the password policy a new password
+	// breaks.
+	Violations []string `json:",omitempty"`
+	// Token is the session token returned by the authenticate op.
+	Token string `json:",omitempty"`
+	// Explanation explains the decision of is_authorized if the command
+	// asked for it.
+	Explanation *user.Explanation `json:",omitempty"`
 }
 
 func (r Response) String() string {
@@ -59,15 +113,27 @@ func (r Response) String() string {
 	return string(data)
 }
 
+// ReloadInterval is how often the server checks the location for changes.
+var ReloadInterval = 2 * time.Second
+
 // Listen starts a tls server on port provided and listens to incoming
-// connections.
-func Listen(port, certLocation string, location string) error {
+// connections. The directory is reloaded whenever the data files of its
+// location change. Clients present certificates as configured by ClientAuth.
+func Listen(port, certLocation string, d *user.Directory) error {
+	stop := d.Watch(ReloadInterval, func(err error) {
+		log.Error(err.Error(), log.SysLog, map[string]interface{}{})
+	})
+	defer stop()
+
 	cer, err := tls.LoadX509KeyPair(certLocation+"/server.crt", certLocation+"/server.key")
 	if err != nil {
 		return err
 	}
 
 	config := &tls.Config{Certificates: []tls.Certificate{cer}}
+	if err := clientAuthConfig(config, certLocation); err != nil {
+		return err
+	}
 	ln, err := tls.Listen("tcp", ":"+port, config)
 	if err != nil {
 		return err
@@ -82,13 +148,26 @@ func Listen(port, certLocation string, location string) error {
 			log.Error(err.Error(), log.SysLog, map[string]interface{}{})
 			continue
 		}
-		go handleConnection(conn, location)
+		go handleConnection(conn, d)
 	}
 }
 
-func handleConnection(conn net.Conn, location string) {
+func handleConnection(conn net.Conn, d *user.Directory) {
 	defer conn.Close()
 
+	// the handshake verifies the client certificate, if any, before the
+	// command is read
+	var cert *x509.Certificate
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			log.Error(err.Error(), log.SysLog, map[string]interface{}{})
+			return
+		}
+		if chains := tlsConn.ConnectionState().VerifiedChains; len(chains) > 0 {
+			cert = chains[0][0]
+		}
+	}
+
 	var cmd Command
 
 	r := bufio.NewReader(conn)
@@ -102,9 +181,13 @@ func handleConnection(conn net.Conn, location string) {
 	}
 
 	json.Unmarshal([]byte(string(req[:n])), &cmd)
-	log.Info(cmd.String(), log.AppLog, map[string]interface{}{})
+	log.Info(cmd.redacted().String(), log.AppLog, map[string]interface{}{})
 
-	response := handleCommand(cmd, location)
+	source, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		source = conn.RemoteAddr().String()
+	}
+	response := handleCommand(cmd, source, cert, d)
 
 	_, err = conn.Write([]byte(response.String()))
 	if err != nil {
@@ -114,12 +197,95 @@ func handleConnection(conn net.Conn, location string) {
 	//}
 }
 
-func handleCommand(cmd Command, location string) *Response {
-	if cmd.Op != "is_authorized" {
-		return &Response{Code: SystemError, Message: "command not supported"}
+// handleCommand executes cmd sent from source. cert is the verified client
+// certificate of the connection, if any, is_authorized authenticates with it
+// when the command carries no credentials.
+func handleCommand(cmd Command, source string, cert *x509.Certificate, d *user.Directory) *Response {
+	var err error
+	switch cmd.Op {
+	case "authenticate":
+		token, err := d.CreateSession(source, cmd.Email, cmd.Password, cmd.TOTP)
+		if err != nil {
+			return errorResponse(err)
+		}
+		return &Response{Code: Success, Message: "Success", Token: token}
+	case "is_authorized":
+		action := cmd.Action
+		if action == "" {
+			action = user.ActionRead
+		}
+		if cmd.Explain {
+			return explain(cmd, source, cert, action, d)
+		}
+		switch {
+		case cmd.Token != "":
+			err = d.AuthorizeToken(cmd.Token, cmd.Resource, action)
+		case cmd.APIKey != "":
+			err = d.AuthorizeAPIKey(source, cmd.APIKey, cmd.Resource, action)
+		case cmd.Email == "" && cert != nil:
+			err = d.AuthorizeCertificate(cert, cmd.Resource, action)
+		default:
+			err = d.AuthorizeFrom(source, cmd.Email, cmd.Password, cmd.TOTP, cmd.Resource, action)
+		}
+	case "change_password":
+		err = d.ChangePasswordFrom(source, cmd.Email, cmd.Password, cmd.TOTP, cmd.NewPassword, cmd.NewPassword)
+	case "reset_password":
+		err = d.ResetPasswordFrom(source, cmd.Email, cmd.ResetToken, cmd.NewPassword, cmd.NewPassword)
+	default:
+		return &Response{Code: InvalidRequest, Message: "command not supported"}
 	}
-	if err := user.Authorize(cmd.Email, cmd.Password, location, cmd.Resource); err != nil {
-		return &Response{Code: SystemError, Message: err.Error()}
+	if err != nil {
+		return errorResponse(err)
 	}
 	return &Response{Code: Success, Message: "Success"}
 }
+
+// explain authenticates the user of cmd like is_authorized and explains the
+// authorization of action on the resource of cmd. File permissions of roles
+// the user does not hold are left out, see user.Explanation.Redacted.
+func explain(cmd Command, source string, cert *x509.Certificate, action string, d *user.Directory) *Response {
+	email := cmd.Email
+	switch {
+	case cmd.Token != "":
+		s, err := d.Introspect(cmd.Token)
+		if err != nil {
+			return errorResponse(err)
+		}
+		email = s.Email
+	case cmd.APIKey != "":
+		u, err := d.AuthenticateAPIKey(source, cmd.APIKey)
+		if err != nil {
+			return errorResponse(err)
+		}
+		email = u.Email
+	case cmd.Email == "" && cert != nil:
+		u, err := d.AuthenticateCertificate(cert)
+		if err != nil {
+			return errorResponse(err)
+		}
+		email = u.Email
+	default:
+		if err := d.AuthenticateFrom(source, cmd.Email, cmd.Password, cmd.TOTP); err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	e, err := d.Explain(email, cmd.Resource, action)
+	r := &Response{Code: Success, Message: "Success"}
+	if err != nil {
+		r = errorResponse(err)
+	}
+	e = e.Redacted()
+	r.Explanation = &e
+	return r
+}
+
+func errorResponse(err error) *Response {
+	r := &Response{Code: ExitCodeOf(err), Message: err.Error()}
+	if pe, ok := err.(*user.PasswordPolicyError); ok {
+		for _, v := range pe.Violations {
+			r.Violations = append(r.Violations, v.Message)
+		}
+	}
+	return r
+}
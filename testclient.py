@@ -9,7 +9,8 @@ cmd = {
   "op": "is_authorized",
   "email": "ameyabhurke@outlook.com",
   "password": "password",
-  "resource": "/home/abhurke/userd"
+  "resource": "/home/abhurke/userd",
+  "action": "read"
 }
 cmdStr = json.dumps(cmd)
 
@@ -21,7 +22,9 @@ client_cert = 'client.crt'
 client_key = 'client.key'
 
 context = ssl.create_default_context(ssl.Purpose.SERVER_AUTH, cafile=server_cert)
-#context.load_cert_chain(certfile=client_cert, keyfile=client_key)
+# the client certificate authenticates the user it is mapped to, when the
+# server runs with -client-auth optional or required
+context.load_cert_chain(certfile=client_cert, keyfile=client_key)
 
 s = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
 conn = context.wrap_socket(s, server_side=False, server_hostname=server_sni_hostname)
@@ -0,0 +1,77 @@
+package user
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Actions granted by file permissions. Besides read and write, file
+// permissions may grant custom verbs such as deploy or delete.
+const (
+	// ActionRead is the action of reading a resource.
+	ActionRead = "read"
+	// ActionWrite is the action of writing a resource.
+	ActionWrite = "write"
+	// AnyAction grants every action, including custom verbs. File
+	// permissions stored before actions were introduced grant AnyAction.
+	AnyAction = "*"
+)
+
+// actionPattern matches custom verbs, for e.g. deploy or purge-cache.
+var actionPattern = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+
+// Actions returns the actions of p.
+func (p AccessPermissions) Actions() []string {
+	switch p {
+	case Read:
+		return []string{ActionRead}
+	case Write:
+		return []string{ActionWrite}
+	}
+	return []string{ActionRead, ActionWrite}
+}
+
+// ParseActions parses a comma separated list of actions, for e.g.
+// read,write,deploy.
+func ParseActions(value string) ([]string, error) {
+	var actions []string
+	for _, a := range strings.Split(value, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		if err := checkAction(a); err != nil {
+			return nil, err
+		}
+		actions = append(actions, a)
+	}
+	if len(actions) == 0 {
+		return nil, newError(ErrInvalid, "at least one action is required")
+	}
+	return actions, nil
+}
+
+// checkAction returns an error if a file permission can't grant action.
+func checkAction(action string) error {
+	if action != AnyAction && !actionPattern.MatchString(action) {
+		return newError(ErrInvalid, "invalid action "+action+", actions are lower case words such as read, write or deploy")
+	}
+	return nil
+}
+
+// Allows reports whether fp grants action. File permissions which deny
+// actions allow none.
+func (fp FilePermission) Allows(action string) bool {
+	return !fp.Deny && fp.covers(action)
+}
+
+// covers reports whether action is one of the actions of fp, regardless of
+// whether fp grants or denies them.
+func (fp FilePermission) covers(action string) bool {
+	for _, a := range fp.Actions {
+		if a == action || a == AnyAction {
+			return true
+		}
+	}
+	return false
+}
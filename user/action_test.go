@@ -0,0 +1,71 @@
+package user
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestActions(t *testing.T) {
+	d, _ := openWithSettings(t, "")
+	if err := d.Initialize("actions@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := d.User("actions@openspock.org")
+	if _, err := d.CreateFP("/data/app", &u, &Role{}, []string{"Deploy"}, time.Now().Add(time.Hour)); !errors.Is(err, ErrInvalid) {
+		t.Errorf("expected an invalid action to be rejected, got %v", err)
+	}
+	if _, err := d.CreateFP("/data/app", &u, &Role{}, nil, time.Now().Add(time.Hour)); !errors.Is(err, ErrInvalid) {
+		t.Errorf("expected a file permission without actions to be rejected, got %v", err)
+	}
+	actions, err := ParseActions("read, deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CreateFP("/data/app", &u, &Role{}, actions, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	for action, allowed := range map[string]bool{ActionRead: true, "deploy": true, ActionWrite: false, "delete": false} {
+		err := d.Authorize("actions@openspock.org", "password", "", "/data/app", action)
+		if allowed && err != nil {
+			t.Errorf("%s should be allowed: %v", action, err)
+		}
+		if !allowed && !errors.Is(err, ErrNotAuthorized) {
+			t.Errorf("%s should not be allowed, got %v", action, err)
+		}
+	}
+
+	if _, err := d.CreateFP("/data/app", &u, &Role{}, Write.Actions(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Authorize("actions@openspock.org", "password", "", "/data/app", ActionWrite); err != nil {
+		t.Errorf("assigning again should replace the actions: %v", err)
+	}
+	if err := d.Authorize("actions@openspock.org", "password", "", "/data/app", ActionRead); err == nil {
+		t.Error("assigning again should replace the actions")
+	}
+}
+
+func TestLegacyFilePermissionsGrantAnyAction(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := "#userd,filepermission,2\n/data/legacy,,,2020-01-01T00:00:00Z,2999-01-01T00:00:00Z,5,put\n"
+	if err := ioutil.WriteFile(s.filePermissionConf().name, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Initialize("legacy@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Authorize("legacy@openspock.org", "password", "", "/data/legacy", "deploy"); err != nil {
+		t.Errorf("file permissions stored before actions should grant every action: %v", err)
+	}
+}
@@ -0,0 +1,256 @@
+package user
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/openspock/log"
+)
+
+// apiKeyPrefix starts every API key, so that leaked keys are easy to spot.
+const apiKeyPrefix = "userd_"
+
+// apiKeyTouchInterval is how often the last use of an API key is persisted.
+// Keys used more often only update it once per interval.
+const apiKeyTouchInterval = time.Minute
+
+// errInvalidAPIKey is returned for API keys which are malformed, unknown,
+// expired or revoked.
+var errInvalidAPIKey = newError(ErrBadCredentials, "api key is invalid or has expired")
+
+// APIKey lets a service account authenticate. The key itself is only handed
+// out once, when it is issued, userd keeps a hash of it.
+//
+// An API key looks like userd_<KeyID>_<secret>, its KeyID identifies the key
+// in listings and logs.
+//
+// API keys are stored in apikey.conf
+type APIKey struct {
+	KeyID string
+	// Account is the name of the service account the key belongs to.
+	Account     string
+	Description string
+	Created     time.Time
+	// Expires is when the key expires, keys with a zero Expires never do.
+	Expires time.Time
+	// LastUsed is when the key was last used to authenticate, accurate to
+	// about a minute.
+	LastUsed time.Time
+	hash     string
+}
+
+func (k APIKey) expired(now time.Time) bool {
+	return !k.Expires.IsZero() && !now.Before(k.Expires)
+}
+
+// hashToken hashes a random token such as an API key. Unlike passwords,
+// random tokens don't need a slow hash.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseAPIKey returns the KeyID of an API key.
+func parseAPIKey(key string) (string, bool) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(key, apiKeyPrefix), "_", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", false
+	}
+	return parts[0], true
+}
+
+// CreateServiceAccount creates a service account. Service accounts are users
+// which are identified by a name instead of an email, have no password and
+// authenticate with API keys only.
+func (d *Directory) CreateServiceAccount(name, description, roleID string) error {
+	log.Info("CreateServiceAccount", log.AppMsg, map[string]interface{}{"account": name, "description": description})
+
+	if name == "" || strings.Contains(name, "@") {
+		return newError(ErrInvalid, "service account names must not be empty or contain an @")
+	}
+	u, err := d.snapshot().newUser(name, description, "", "", "", roleID)
+	if err != nil {
+		return err
+	}
+	u.Service = true
+	if err := d.config.WriteUser(u); err != nil {
+		return err
+	}
+	if err := d.Reload(); err != nil {
+		return err
+	}
+
+	log.Info("CreateServiceAccount", log.AppMsg, map[string]interface{}{"account": name, "result": "success", "message": name + " has been created successfully"})
+	return nil
+}
+
+// IssueAPIKey issues a new API key for a service account and returns it
+// along with its record. The key can't be recovered later. Keys with a zero
+// expiration never expire.
+func (d *Directory) IssueAPIKey(account, description string, expiration time.Time) (string, APIKey, error) {
+	log.Info("IssueAPIKey", log.AppMsg, map[string]interface{}{"account": account, "description": description})
+
+	u, ok := d.User(account)
+	if !ok {
+		return "", APIKey{}, newError(ErrNotFound, account+" does not exist")
+	}
+	if !u.Service {
+		return "", APIKey{}, newError(ErrInvalid, account+" is not a service account")
+	}
+	id, err := randomBytes(6)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	secret, err := randomBytes(32)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	k := APIKey{KeyID: hex.EncodeToString(id), Account: account, Description: description, Created: time.Now(), Expires: expiration}
+	key := apiKeyPrefix + k.KeyID + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	k.hash = hashToken(key)
+	if err := d.config.Apply(Mutation{APIKey: &k}); err != nil {
+		return "", APIKey{}, err
+	}
+	if err := d.Reload(); err != nil {
+		return "", APIKey{}, err
+	}
+
+	log.Info("IssueAPIKey", log.AppMsg, map[string]interface{}{"account": account, "key_id": k.KeyID, "result": "success", "message": "api key issued for " + account})
+	return key, k, nil
+}
+
+// RevokeAPIKey revokes an API key by its KeyID.
+func (d *Directory) RevokeAPIKey(keyID string) error {
+	log.Info("RevokeAPIKey", log.AppMsg, map[string]interface{}{"key_id": keyID})
+
+	k, ok := d.snapshot().apiKeys[keyID]
+	if !ok {
+		return newError(ErrNotFound, keyID+" api key does not exist")
+	}
+	if err := d.config.Apply(Mutation{APIKey: &k, Delete: true}); err != nil {
+		return err
+	}
+	if err := d.Reload(); err != nil {
+		return err
+	}
+
+	log.Info("RevokeAPIKey", log.AppMsg, map[string]interface{}{"key_id": keyID, "result": "success", "message": "api key of " + k.Account + " has been revoked"})
+	return nil
+}
+
+// ListAPIKeys lists the API keys of a service account, or of all service
+// accounts if account is empty, sorted by the time they were issued.
+// Expired keys are listed until they are revoked.
+func (d *Directory) ListAPIKeys(account string) []APIKey {
+	var keys []APIKey
+	for _, k := range d.snapshot().apiKeys {
+		if account == "" || k.Account == account {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.Before(keys[j].Created)
+	})
+	return keys
+}
+
+// AuthenticateAPIKey authenticates an API key sent from source and returns
+// its service account. Failed attempts are throttled per source like failed
+// logins, see AuthenticateFrom.
+func (d *Directory) AuthenticateAPIKey(source, key string) (User, error) {
+	now := time.Now()
+	if err := d.checkAttempts(source, User{}, now); err != nil {
+		return User{}, err
+	}
+	k, err := d.verifyAPIKey(key, now)
+	if err != nil {
+		log.Info("AuthenticateAPIKey", log.AppMsg, map[string]interface{}{"key_id": k.KeyID, "source": source, "result": "failure", "message": err.Error()})
+		d.recordFailure(source, "", now)
+		return User{}, errInvalidAPIKey
+	}
+	d.recordSuccess(source, "")
+	d.touchAPIKey(k, now)
+
+	log.Info("AuthenticateAPIKey", log.AppMsg, map[string]interface{}{"account": k.Account, "key_id": k.KeyID, "source": source, "result": "success", "message": "service account successfully authenticated"})
+	u, _ := d.User(k.Account)
+	return u, nil
+}
+
+func (d *Directory) verifyAPIKey(key string, now time.Time) (APIKey, error) {
+	id, ok := parseAPIKey(key)
+	if !ok {
+		return APIKey{}, errors.New("malformed api key")
+	}
+	t := d.snapshot()
+	k, ok := t.apiKeys[id]
+	if !ok {
+		return APIKey{KeyID: id}, errors.New("api key does not exist")
+	}
+	if subtle.ConstantTimeCompare([]byte(k.hash), []byte(hashToken(key))) != 1 {
+		return k, errors.New("api key does not match")
+	}
+	if k.expired(now) {
+		return k, errors.New("api key expired")
+	}
+	u, ok := t.users[k.Account]
+	if !ok || !u.Service {
+		return k, errors.New(k.Account + " is not a service account")
+	}
+	return k, u.checkStatus(now)
+}
+
+// touchAPIKey persists the last use of an API key. The key is read again
+// under the store's lock, a key revoked meanwhile by another process is left
+// revoked. Failures are logged, they never fail an authentication.
+func (d *Directory) touchAPIKey(k APIKey, now time.Time) {
+	if d.readOnly() || now.Sub(k.LastUsed) < apiKeyTouchInterval {
+		return
+	}
+	err := d.config.UpdateAPIKey(k.KeyID, func(k *APIKey) ([]Mutation, error) {
+		k.LastUsed = now
+		return nil, nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return
+	}
+	if err != nil {
+		log.Error("AuthenticateAPIKey", log.AppMsg, map[string]interface{}{"key_id": k.KeyID, "result": "failure", "message": err.Error()})
+		return
+	}
+	if err := d.Reload(); err != nil {
+		log.Error("AuthenticateAPIKey", log.AppMsg, map[string]interface{}{"key_id": k.KeyID, "result": "failure", "message": err.Error()})
+	}
+}
+
+// AuthorizeAPIKey authorizes an action on a resource for the service account
+// of an API key sent from source.
+func (d *Directory) AuthorizeAPIKey(source, key, resource, action string) error {
+	log.Info("AuthorizeAPIKey", log.AppMsg, map[string]interface{}{"source": source, "resource": resource, "action": action})
+
+	u, err := d.AuthenticateAPIKey(source, key)
+	if err != nil {
+		return err
+	}
+	return d.authorize(u.Email, resource, action)
+}
+
+// apiKeysOf returns mutations which revoke all API keys of a service account.
+func (t *tables) apiKeysOf(account string) []Mutation {
+	var mutations []Mutation
+	for _, k := range t.apiKeys {
+		if k.Account == account {
+			k := k
+			mutations = append(mutations, Mutation{APIKey: &k, Delete: true})
+		}
+	}
+	return mutations
+}
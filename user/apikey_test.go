@@ -0,0 +1,126 @@
+package user
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeys(t *testing.T) {
+	d, dir := openWithSettings(t, "throttle.delay,0s\n")
+	if err := d.Initialize("admin@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	role, err := d.CreateRole("service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateServiceAccount("backup@openspock.org", "backups", role.RoleID); err == nil {
+		t.Error("service account names with an @ should be rejected")
+	}
+	if err := d.CreateServiceAccount("backup", "backups", role.RoleID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := d.IssueAPIKey("admin@openspock.org", "", time.Time{}); err == nil {
+		t.Error("api keys should only be issued for service accounts")
+	}
+	if err := d.Authenticate("backup", "", ""); err == nil {
+		t.Error("service accounts should not authenticate with a password")
+	}
+
+	key, k, err := d.IssueAPIKey("backup", "nightly", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, apiKeyPrefix+k.KeyID+"_") {
+		t.Errorf("api key %s should start with its key id %s", key, k.KeyID)
+	}
+	u, _ := d.User("backup")
+	if _, err := d.CreateFP("/data/backup", &u, &Role{}, []string{ActionRead}, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AuthorizeAPIKey("10.0.0.1", key, "/data/backup", ActionRead); err != nil {
+		t.Error(err)
+	}
+	if err := d.AuthorizeAPIKey("10.0.0.1", key+"x", "/data/backup", ActionRead); err != errInvalidAPIKey {
+		t.Errorf("expected a wrong api key to be rejected, got %v", err)
+	}
+
+	reopened, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := reopened.ListAPIKeys("backup")
+	if len(keys) != 1 || keys[0].LastUsed.IsZero() || keys[0].Description != "nightly" {
+		t.Errorf("expected the used api key to be listed, got %+v", keys)
+	}
+	s, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(s.apiKeyConf().name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), key) {
+		t.Error("api keys should only be stored as hashes")
+	}
+
+	expired, _, err := reopened.IssueAPIKey("backup", "expired", time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.AuthenticateAPIKey("", expired); err != errInvalidAPIKey {
+		t.Errorf("expected an expired api key to be rejected, got %v", err)
+	}
+	if err := reopened.RevokeAPIKey(k.KeyID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.AuthenticateAPIKey("", key); err != errInvalidAPIKey {
+		t.Errorf("expected a revoked api key to be rejected, got %v", err)
+	}
+
+	if err := reopened.DeleteUser("backup"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := reopened.ListAPIKeys(""); len(keys) != 0 {
+		t.Errorf("deleting a service account should revoke its api keys, got %+v", keys)
+	}
+}
+
+func TestUsingARevokedAPIKeyKeepsItRevoked(t *testing.T) {
+	d, dir := openWithSettings(t, "throttle.delay,0s\n")
+	if err := d.Initialize("admin@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	role, err := d.CreateRole("service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateServiceAccount("backup", "backups", role.RoleID); err != nil {
+		t.Fatal(err)
+	}
+	key, k, err := d.IssueAPIKey("backup", "nightly", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a second directory stands in for a server which hasn't seen the
+	// revocation yet
+	other, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RevokeAPIKey(k.KeyID); err != nil {
+		t.Fatal(err)
+	}
+	other.AuthenticateAPIKey("", key)
+
+	reopened, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.AuthenticateAPIKey("", key); err != errInvalidAPIKey {
+		t.Errorf("expected the use of a stale key not to bring it back, got %v", err)
+	}
+}
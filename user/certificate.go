@@ -0,0 +1,151 @@
+package user
+
+import (
+	"crypto/x509"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/openspock/log"
+)
+
+// Prefixes of certificate identities, see CertificateIdentities.
+var certIdentityPrefixes = []string{"email:", "dns:", "uri:", "subject:"}
+
+// CertMapping maps the identity of a client certificate to a user, so that
+// the user can authenticate with the certificate instead of a password.
+//
+// Certificate mappings are stored in certmapping.conf
+type CertMapping struct {
+	// Identity is a subject or subject alternative name of certificates, for
+	// e.g. subject:CN=backup,O=openspock or dns:backup.openspock.org.
+	Identity string
+	Email    string
+}
+
+// CertificateIdentities returns the identities of a certificate in the order
+// they are looked up: the email addresses, DNS names and URIs of its subject
+// alternative names followed by its subject.
+func CertificateIdentities(cert *x509.Certificate) []string {
+	var identities []string
+	for _, email := range cert.EmailAddresses {
+		identities = append(identities, "email:"+email)
+	}
+	for _, name := range cert.DNSNames {
+		identities = append(identities, "dns:"+name)
+	}
+	for _, uri := range cert.URIs {
+		identities = append(identities, "uri:"+uri.String())
+	}
+	return append(identities, "subject:"+cert.Subject.String())
+}
+
+func validCertIdentity(identity string) bool {
+	for _, prefix := range certIdentityPrefixes {
+		if strings.HasPrefix(identity, prefix) && len(identity) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// MapCertificate maps a certificate identity to a user. An identity maps to
+// at most one user, mapping it again replaces the previous mapping.
+func (d *Directory) MapCertificate(identity, email string) error {
+	log.Info("MapCertificate", log.AppMsg, map[string]interface{}{"identity": identity, "email": email})
+
+	if !validCertIdentity(identity) {
+		return newError(ErrInvalid, identity+" is not a certificate identity, it has to start with one of "+strings.Join(certIdentityPrefixes, ", "))
+	}
+	if _, ok := d.User(email); !ok {
+		return newError(ErrNotFound, email+" does not exist")
+	}
+	if err := d.config.Apply(Mutation{CertMapping: &CertMapping{identity, email}}); err != nil {
+		return err
+	}
+	if err := d.Reload(); err != nil {
+		return err
+	}
+
+	log.Info("MapCertificate", log.AppMsg, map[string]interface{}{"identity": identity, "email": email, "result": "success", "message": identity + " has been mapped to " + email})
+	return nil
+}
+
+// UnmapCertificate removes the mapping of a certificate identity.
+func (d *Directory) UnmapCertificate(identity string) error {
+	log.Info("UnmapCertificate", log.AppMsg, map[string]interface{}{"identity": identity})
+
+	m, ok := d.snapshot().certMappings[identity]
+	if !ok {
+		return newError(ErrNotFound, identity+" is not mapped")
+	}
+	if err := d.config.Apply(Mutation{CertMapping: &m, Delete: true}); err != nil {
+		return err
+	}
+	if err := d.Reload(); err != nil {
+		return err
+	}
+
+	log.Info("UnmapCertificate", log.AppMsg, map[string]interface{}{"identity": identity, "result": "success", "message": "mapping of " + identity + " has been removed"})
+	return nil
+}
+
+// ListCertificateMappings lists all certificate mappings sorted by identity.
+func (d *Directory) ListCertificateMappings() []CertMapping {
+	var mappings []CertMapping
+	for _, m := range d.snapshot().certMappings {
+		mappings = append(mappings, m)
+	}
+	sort.Slice(mappings, func(i, j int) bool {
+		return mappings[i].Identity < mappings[j].Identity
+	})
+	return mappings
+}
+
+// AuthenticateCertificate returns the user a client certificate is mapped
+// to. The certificate has to be verified already, for e.g. by the TLS
+// handshake.
+func (d *Directory) AuthenticateCertificate(cert *x509.Certificate) (User, error) {
+	t := d.snapshot()
+	for _, identity := range CertificateIdentities(cert) {
+		m, ok := t.certMappings[identity]
+		if !ok {
+			continue
+		}
+		u, ok := t.users[m.Email]
+		if !ok {
+			return User{}, newError(ErrNotFound, m.Email+" does not exist")
+		}
+		if err := u.checkStatus(time.Now()); err != nil {
+			return User{}, err
+		}
+		log.Info("AuthenticateCertificate", log.AppMsg, map[string]interface{}{"identity": identity, "email": u.Email, "result": "success", "message": "user successfully authenticated"})
+		return u, nil
+	}
+	return User{}, newError(ErrBadCredentials, "certificate "+cert.Subject.String()+" is not mapped to a user")
+}
+
+// AuthorizeCertificate authorizes an action on a resource for the user a
+// verified client certificate is mapped to.
+func (d *Directory) AuthorizeCertificate(cert *x509.Certificate, resource, action string) error {
+	log.Info("AuthorizeCertificate", log.AppMsg, map[string]interface{}{"subject": cert.Subject.String(), "resource": resource, "action": action})
+
+	u, err := d.AuthenticateCertificate(cert)
+	if err != nil {
+		return err
+	}
+	return d.authorize(u.Email, resource, action)
+}
+
+// certMappingsOf returns mutations which remove all certificate mappings of a
+// user.
+func (t *tables) certMappingsOf(email string) []Mutation {
+	var mutations []Mutation
+	for _, m := range t.certMappings {
+		if m.Email == email {
+			m := m
+			mutations = append(mutations, Mutation{CertMapping: &m, Delete: true})
+		}
+	}
+	return mutations
+}
@@ -0,0 +1,90 @@
+package user
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func newCertificate(t *testing.T, subject pkix.Name, dnsNames ...string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      subject,
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCertificateMappings(t *testing.T) {
+	d, dir := openWithSettings(t, "")
+	if err := d.Initialize("cert@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	host := newCertificate(t, pkix.Name{CommonName: "backup", Organization: []string{"openspock"}}, "backup.openspock.org")
+	other := newCertificate(t, pkix.Name{CommonName: "other"})
+
+	if identities := CertificateIdentities(host); len(identities) != 2 || identities[0] != "dns:backup.openspock.org" || identities[1] != "subject:CN=backup,O=openspock" {
+		t.Errorf("unexpected identities %v", identities)
+	}
+	if err := d.MapCertificate("CN=backup", "cert@openspock.org"); err == nil {
+		t.Error("identities without a prefix should be rejected")
+	}
+	if err := d.MapCertificate("dns:backup.openspock.org", "nobody@openspock.org"); err == nil {
+		t.Error("identities should only be mapped to existing users")
+	}
+	if err := d.MapCertificate("subject:CN=backup,O=openspock", "cert@openspock.org"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := d.AuthenticateCertificate(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Email != "cert@openspock.org" {
+		t.Errorf("expected the certificate to authenticate cert@openspock.org, got %s", u.Email)
+	}
+	if _, err := d.AuthenticateCertificate(other); err == nil {
+		t.Error("unmapped certificates should be rejected")
+	}
+
+	reopened, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mappings := reopened.ListCertificateMappings(); len(mappings) != 1 || mappings[0].Email != "cert@openspock.org" {
+		t.Errorf("expected the mapping to be stored, got %+v", mappings)
+	}
+	if err := reopened.DisableUser("cert@openspock.org"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.AuthenticateCertificate(host); err != errAccountDisabled {
+		t.Errorf("expected the certificate of a disabled user to be refused, got %v", err)
+	}
+	if err := reopened.UnmapCertificate("subject:CN=backup,O=openspock"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.AuthenticateCertificate(host); err == nil || err == errAccountDisabled {
+		t.Errorf("expected the unmapped certificate to be rejected, got %v", err)
+	}
+	if err := reopened.UnmapCertificate("subject:CN=backup,O=openspock"); err == nil {
+		t.Error("unmapping an unmapped identity should fail")
+	}
+}
@@ -0,0 +1,65 @@
+package user
+
+import (
+	"strings"
+	"time"
+
+	"github.com/openspock/log"
+)
+
+// File permissions which deny actions take precedence over file permissions
+// which grant them, for e.g. a role contractor may never access /finance/**
+// even if the user or another role of the user is granted access to it. A
+// deny is only overridden by a grant for a more specific pattern, see
+// moreSpecific, so that exceptions such as /finance/public/** remain
+// possible. See explain for how file permissions are evaluated.
+
+// DenyFP creates a new file permission for either a user or a role which
+// denies actions on a resource. If neither is given, the actions are denied
+// to everyone. It replaces the actions of an existing deny for the same user
+// or role.
+func (d *Directory) DenyFP(file string, user *User, role *Role, actions []string, expiration time.Time) (*FilePermission, error) {
+	log.Info("DenyFP", log.AppMsg, map[string]interface{}{"file": file, "actions": strings.Join(actions, ",")})
+
+	fp, err := NewFP(file, *user, *role, actions, expiration)
+	if err != nil {
+		return nil, err
+	}
+	fp.Deny = true
+
+	if err := d.config.WriteFP(fp); err != nil {
+		return nil, err
+	}
+	if err := d.Reload(); err != nil {
+		return nil, err
+	}
+
+	log.Info("DenyFP", log.AppMsg, map[string]interface{}{"file": file, "result": "success", "message": "Deny for " + file + " has been created"})
+	return fp, nil
+}
+
+// DenyGroupFP creates a new file permission for a group which denies actions
+// on a resource to all its members. It replaces the actions of an existing
+// deny for the same group.
+func (d *Directory) DenyGroupFP(file, group string, actions []string, expiration time.Time) (*FilePermission, error) {
+	log.Info("DenyGroupFP", log.AppMsg, map[string]interface{}{"file": file, "group": group, "actions": strings.Join(actions, ",")})
+
+	if err := checkGroup(group); err != nil {
+		return nil, err
+	}
+	fp, err := NewFP(file, User{}, Role{}, actions, expiration)
+	if err != nil {
+		return nil, err
+	}
+	fp.Group, fp.Deny = group, true
+
+	if err := d.config.WriteFP(fp); err != nil {
+		return nil, err
+	}
+	if err := d.Reload(); err != nil {
+		return nil, err
+	}
+
+	log.Info("DenyGroupFP", log.AppMsg, map[string]interface{}{"file": file, "group": group, "result": "success", "message": "Deny for " + file + " has been created"})
+	return fp, nil
+}
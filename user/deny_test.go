@@ -0,0 +1,78 @@
+package user
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDenyPrecedence(t *testing.T) {
+	d, dir := openWithSettings(t, "")
+	if err := d.Initialize("admin@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	contractor, err := d.CreateRole("contractor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateUser("casey@openspock.org", "password", "", contractor.RoleID); err != nil {
+		t.Fatal(err)
+	}
+	casey, _ := d.User("casey@openspock.org")
+	expiration := time.Now().Add(time.Hour)
+	if _, err := d.CreateFP("/finance/**", &casey, &Role{}, []string{AnyAction}, expiration); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CreateFP("/finance/public/**", &casey, &Role{}, []string{ActionRead}, expiration); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DenyFP("/finance/**", &User{}, contractor, []string{AnyAction}, expiration); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DenyFP("/finance/public/drafts/**", &User{}, &Role{}, []string{ActionRead}, expiration); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DenyGroupFP("/finance/public/**", "interns", []string{ActionRead}, expiration); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DenyFP("/finance/public/q2.csv", &casey, &Role{}, []string{ActionWrite}, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorize := func(resource, action string) error {
+		return reopened.Authorize("casey@openspock.org", "password", "", resource, action)
+	}
+	if err := authorize("/finance/ledger.csv", ActionRead); !errors.Is(err, ErrNotAuthorized) {
+		t.Errorf("a deny of a role should override a grant for the same pattern, got %v", err)
+	}
+	if err := authorize("/finance/public/q3.csv", ActionRead); err != nil {
+		t.Errorf("a more specific grant should override a deny: %v", err)
+	}
+	if err := authorize("/finance/public/drafts/q4.csv", ActionRead); !errors.Is(err, ErrNotAuthorized) {
+		t.Errorf("a deny for everyone should apply, got %v", err)
+	}
+	if err := authorize("/finance/public/q2.csv", ActionRead); err != nil {
+		t.Errorf("expired denies should be skipped: %v", err)
+	}
+
+	if err := reopened.AddUserToGroup("casey@openspock.org", "interns"); err != nil {
+		t.Fatal(err)
+	}
+	if err := authorize("/finance/public/q3.csv", ActionRead); !errors.Is(err, ErrNotAuthorized) {
+		t.Errorf("a deny of a group should override a grant for the same pattern, got %v", err)
+	}
+	if err := reopened.RevokeGroupFP("/finance/public/**", "interns"); err != nil {
+		t.Fatal(err)
+	}
+	if err := authorize("/finance/public/q3.csv", ActionRead); err != nil {
+		t.Errorf("revoked denies should no longer apply: %v", err)
+	}
+
+	if !(FilePermission{Actions: []string{AnyAction}, Deny: true}).covers(ActionRead) || (FilePermission{Actions: []string{AnyAction}, Deny: true}).Allows(ActionRead) {
+		t.Error("denies should cover their actions without allowing them")
+	}
+}
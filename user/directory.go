@@ -0,0 +1,344 @@
+package user
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/openspock/log"
+)
+
+// Directory holds the users, roles and file permissions of a location. The
+// userd operations are methods on a Directory.
+//
+// A Directory is safe for concurrent use. Its tables are never modified in
+// place, Reload reads the location into new tables and swaps them in as a
+// whole. Operations which write to the location reload it afterwards.
+type Directory struct {
+	config *Configuration
+
+	mu sync.RWMutex
+	t  *tables
+
+	// attemptsMu guards the in-memory counts of failed authentication
+	// attempts, sources counts them per source and accounts per user of
+	// read-only locations. steps holds the last accepted TOTP time step per
+	// user of read-only locations.
+	attemptsMu sync.Mutex
+	sources    map[string]attempts
+	accounts   map[string]attempts
+	steps      map[string]int64
+}
+
+// tables is a snapshot of the records of a location.
+type tables struct {
+	// users is a map of user email to User
+	users map[string]User
+	// roles is a map of RoleID to Role
+	roles map[string]Role
+	// fps is a map of grantee to a map of File to FilePermission, see
+	// grantee
+	fps map[string]map[string][]FilePermission
+	// resources is a map of grantee to the resource patterns of fps
+	resources map[string]*resourceTrie
+	// sessions is a map of SessionID to Session
+	sessions map[string]Session
+	// apiKeys is a map of KeyID to APIKey
+	apiKeys map[string]APIKey
+	// certMappings is a map of certificate identity to CertMapping
+	certMappings map[string]CertMapping
+	// settings are the settings of the location
+	settings Settings
+	// policy is the password policy of the location
+	policy PasswordPolicy
+	// lockout is the lockout policy of the location
+	lockout LockoutPolicy
+}
+
+// Open loads the Directory of a location, for e.g. file:///etc/userd.
+func Open(location string) (*Directory, error) {
+	c, err := NewConfig(location)
+	if err != nil {
+		return nil, err
+	}
+	d := &Directory{config: c, sources: make(map[string]attempts), accounts: make(map[string]attempts), steps: make(map[string]int64)}
+	if err := d.Reload(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Config returns the configuration of the location.
+func (d *Directory) Config() *Configuration {
+	return d.config
+}
+
+// Reload reads the location and swaps in its current records. Interrupted
+// writes are recovered and records stored in an older layout are migrated
+// first. If reading fails, the previously loaded records are kept.
+func (d *Directory) Reload() error {
+	t, err := d.config.read()
+	if err != nil {
+		return storageError(err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.t = t
+	return nil
+}
+
+// snapshot returns the current tables. They must not be modified.
+func (d *Directory) snapshot() *tables {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.t
+}
+
+// User returns the user with an email.
+func (d *Directory) User(email string) (User, bool) {
+	u, ok := d.snapshot().users[email]
+	return u, ok
+}
+
+// Role returns the role with a RoleID.
+func (d *Directory) Role(roleID string) (Role, bool) {
+	r, ok := d.snapshot().roles[roleID]
+	return r, ok
+}
+
+// LookupUser returns the user with an email, or an ErrNotFound error if
+// there is none.
+func (d *Directory) LookupUser(email string) (User, error) {
+	u, ok := d.User(email)
+	if !ok {
+		return u, newError(ErrNotFound, email+" does not exist")
+	}
+	return u, nil
+}
+
+// LookupRole returns the role with a RoleID, or an ErrNotFound error if
+// there is none.
+func (d *Directory) LookupRole(roleID string) (Role, error) {
+	r, ok := d.Role(roleID)
+	if !ok {
+		return r, newError(ErrNotFound, roleID+" does not exist")
+	}
+	return r, nil
+}
+
+// UserCount returns the number of users.
+func (d *Directory) UserCount() int {
+	return len(d.snapshot().users)
+}
+
+// read reads the current records of the store into new tables. Writers are
+// kept out while reading.
+//
+// 1. init user conf
+// 2. init role conf
+// 3. init fperm conf
+// 4. init session conf
+// 5. init api key conf
+// 6. init settings
+func (c *Configuration) read() (*tables, error) {
+	if err := c.Store.Recover(); err != nil {
+		return nil, err
+	}
+	if err := c.Store.Migrate(); err != nil {
+		return nil, err
+	}
+	unlock, err := c.Store.RLock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	t := &tables{
+		users:        make(map[string]User),
+		roles:        make(map[string]Role),
+		fps:          make(map[string]map[string][]FilePermission),
+		resources:    make(map[string]*resourceTrie),
+		sessions:     make(map[string]Session),
+		apiKeys:      make(map[string]APIKey),
+		certMappings: make(map[string]CertMapping),
+	}
+
+	users, err := c.Store.ReadUsers()
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		t.users[u.Email] = u
+	}
+
+	roles, err := c.Store.ReadRoles()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range roles {
+		t.roles[r.RoleID] = r
+	}
+
+	fps, err := c.Store.ReadFPs()
+	if err != nil {
+		return nil, err
+	}
+	for _, fp := range fps {
+		fp.Role = t.roles[fp.Role.RoleID]
+		t.insertFP(fp)
+	}
+
+	sessions, err := c.Store.ReadSessions()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sessions {
+		t.sessions[s.SessionID] = s
+	}
+
+	keys, err := c.Store.ReadAPIKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		t.apiKeys[k.KeyID] = k
+	}
+
+	mappings, err := c.Store.ReadCertMappings()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range mappings {
+		t.certMappings[m.Identity] = m
+	}
+
+	if t.settings, err = c.Store.ReadSettings(); err != nil {
+		return nil, err
+	}
+	var dir string
+	if c.FileAccessProtocol == File {
+		dir = c.Location
+	}
+	if t.policy, err = newPasswordPolicy(t.settings, dir); err != nil {
+		return nil, err
+	}
+	if t.lockout, err = newLockoutPolicy(t.settings); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// withRole returns a copy of the tables which also holds r.
+func (t *tables) withRole(r Role) *tables {
+	roles := make(map[string]Role, len(t.roles)+1)
+	for k, v := range t.roles {
+		roles[k] = v
+	}
+	roles[r.RoleID] = r
+	return &tables{users: t.users, roles: roles, fps: t.fps, resources: t.resources, sessions: t.sessions, apiKeys: t.apiKeys, certMappings: t.certMappings, settings: t.settings, policy: t.policy, lockout: t.lockout}
+}
+
+func (t *tables) insertFP(fp FilePermission) {
+	g := grantee(fp)
+	if t.fps[g] == nil {
+		t.fps[g] = make(map[string][]FilePermission)
+		t.resources[g] = newResourceTrie()
+	}
+	if _, ok := t.fps[g][fp.File]; !ok {
+		t.resources[g].insert(fp.File)
+	}
+	t.fps[g][fp.File] = append(t.fps[g][fp.File], fp)
+}
+
+// grantee returns who a file permission is granted to - the UserID for
+// users, the groupGrantee of the group for groups and "" for roles.
+func grantee(fp FilePermission) string {
+	if fp.Group != "" {
+		return groupGrantee(fp.Group)
+	}
+	return fp.UserID
+}
+
+// signer is implemented by stores which can tell if they changed without
+// reading all records.
+type signer interface {
+	// signature changes whenever the records of the store change.
+	signature() (string, error)
+}
+
+// Watch polls the location every interval and reloads it whenever its data
+// files change. Failed reloads are reported to onError, the Directory keeps
+// serving the previously loaded records until a reload succeeds. Call the
+// returned function to stop watching.
+func (d *Directory) Watch(interval time.Duration, onError func(error)) func() {
+	stop := make(chan struct{})
+	signature, err := storeSignature(d.config.Store)
+	if err != nil {
+		onError(err)
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				signature = d.reloadChanged(signature, onError)
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// reloadChanged reloads the location if its signature changed and returns the
+// signature of the loaded records. Stores which can't sign themselves are
+// reloaded on every call.
+func (d *Directory) reloadChanged(previous string, onError func(error)) string {
+	signature, err := storeSignature(d.config.Store)
+	if err != nil {
+		onError(err)
+		return previous
+	}
+	if signature != "" && signature == previous {
+		return previous
+	}
+	if err := d.Reload(); err != nil {
+		onError(fmt.Errorf("reloading %s: %v", d.config.Location, err))
+		return previous
+	}
+	log.Info("Reload", log.AppMsg, map[string]interface{}{"location": d.config.Location, "result": "success", "message": d.config.Location + " has been reloaded"})
+	return signature
+}
+
+func storeSignature(s Store) (string, error) {
+	if signer, ok := s.(signer); ok {
+		return signer.signature()
+	}
+	return "", nil
+}
+
+// signature is built from the size and modification time of the conf files,
+// the settings, the master key and the journal. Conf files are replaced by a rename on every write, so
+// any write changes the signature. A journal left behind by an interrupted
+// write changes it as well, so that the reload recovers it.
+func (s *fileStore) signature() (string, error) {
+	var signature string
+	files := []string{s.masterKeyFileName(), s.settingsFileName(), s.journalFileName()}
+	for _, cf := range s.confFiles() {
+		files = append(files, cf.name)
+	}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if os.IsNotExist(err) {
+			signature += "-;"
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		signature += fmt.Sprintf("%d:%d;", info.Size(), info.ModTime().UnixNano())
+	}
+	return signature, nil
+}
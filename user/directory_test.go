@@ -0,0 +1,96 @@
+package user
+
+import (
+	"errors"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDirectoryWatchReloadsChangedLocation(t *testing.T) {
+	dir := t.TempDir()
+	d, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Initialize("watch@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 10)
+	stop := d.Watch(10*time.Millisecond, func(err error) { errs <- err })
+	defer stop()
+
+	// another process writes to the location
+	other, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, _ := other.User("watch@openspock.org")
+	if err := other.CreateUser("watched@openspock.org", "password", "watched user", admin.RoleID); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitFor(func() error { return d.Authenticate("watched@openspock.org", "password", "") }); err != nil {
+		t.Errorf("new user should be served after reload: %v", err)
+	}
+
+	// a broken conf file must not replace the loaded tables
+	s, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(s.roleConf().name, []byte("#userd,role,2\nbroken\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Error("reload failure should be reported")
+	}
+	if err := d.Authenticate("watched@openspock.org", "password", ""); err != nil {
+		t.Errorf("previous state should still be served: %v", err)
+	}
+}
+
+func TestDirectoryConcurrentAccess(t *testing.T) {
+	d, err := Open("mem://concurrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Initialize("concurrent@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := d.User("concurrent@openspock.org")
+	if _, err := d.CreateFP("/data/concurrent", &u, &Role{}, []string{ActionRead}, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := d.Authorize("concurrent@openspock.org", "password", "", "/data/concurrent", ActionRead); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := d.Reload(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func waitFor(f func() error) error {
+	err := errors.New("timed out")
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if err = f(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,73 @@
+package user
+
+import "errors"
+
+// Kinds of errors returned by a Directory. Errors carry their own message
+// and are matched against their kind with errors.Is, for e.g.
+//
+//	if errors.Is(err, user.ErrNotFound) {
+//		...
+//	}
+var (
+	// ErrNotFound is the kind of errors for users, roles, file permissions
+	// and other records which do not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrExists is the kind of errors for records which already exist.
+	ErrExists = errors.New("already exists")
+	// ErrInvalid is the kind of errors for invalid input, for e.g. a password
+	// which breaks the password policy.
+	ErrInvalid = errors.New("invalid")
+	// ErrBadCredentials is the kind of errors for passwords, second factors,
+	// tokens, API keys, reset tokens and client certificates which are wrong,
+	// expired or revoked.
+	ErrBadCredentials = errors.New("bad credentials")
+	// ErrAccountRefused is the kind of errors for accounts which are locked,
+	// throttled, disabled or expired.
+	ErrAccountRefused = errors.New("account refused")
+	// ErrNotAuthorized is the kind of errors for users without a file
+	// permission for a resource.
+	ErrNotAuthorized = errors.New("not authorized")
+	// ErrPermissionExpired is the kind of errors for file permissions which
+	// expired.
+	ErrPermissionExpired = errors.New("permission expired")
+	// ErrRoleMismatch is the kind of errors for users without the required
+	// role.
+	ErrRoleMismatch = errors.New("role mismatch")
+	// ErrStorage is the kind of errors for locations which can't be read or
+	// written.
+	ErrStorage = errors.New("storage failure")
+)
+
+// kindError is an error of a kind, such as ErrNotFound.
+type kindError struct {
+	kind error
+	msg  string
+	// err is the cause of the error, if any
+	err error
+}
+
+func (e *kindError) Error() string {
+	return e.msg
+}
+
+// Is reports whether target is the kind of e.
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+// newError returns an error of a kind with a message.
+func newError(kind error, msg string) error {
+	return &kindError{kind: kind, msg: msg}
+}
+
+// storageError returns err as an error of kind ErrStorage.
+func storageError(err error) error {
+	if err == nil || errors.Is(err, ErrStorage) {
+		return err
+	}
+	return &kindError{kind: ErrStorage, msg: err.Error(), err: err}
+}
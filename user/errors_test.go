@@ -0,0 +1,56 @@
+package user
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestErrorKinds(t *testing.T) {
+	d, _ := openWithSettings(t, "throttle.delay,0s\n")
+	if err := d.Initialize("kinds@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	role, err := d.CreateRole("reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateUser("reader@openspock.org", "password", "", role.RoleID); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := d.User("reader@openspock.org")
+	if _, err := d.CreateFP("/data/expired", &u, &Role{}, []string{ActionRead}, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, lookupUser := d.LookupUser("nobody@openspock.org")
+	_, lookupRole := d.LookupRole("no-such-role")
+
+	tests := []struct {
+		name string
+		err  error
+		kind error
+	}{
+		{"unknown user", d.Authenticate("nobody@openspock.org", "password", ""), ErrNotFound},
+		{"wrong password", d.Authenticate("reader@openspock.org", "wrong", ""), ErrBadCredentials},
+		{"existing user", d.CreateUser("reader@openspock.org", "password", "", role.RoleID), ErrExists},
+		{"unknown role", d.CreateUser("other@openspock.org", "password", "", "no-such-role"), ErrNotFound},
+		{"no permission", d.Authorize("reader@openspock.org", "password", "", "/data/none", ActionRead), ErrNotAuthorized},
+		{"expired permission", d.Authorize("reader@openspock.org", "password", "", "/data/expired", ActionRead), ErrPermissionExpired},
+		{"role mismatch", d.AuthenticateForRole("reader@openspock.org", "password", "", Admin), ErrRoleMismatch},
+		{"password policy", d.ChangePassword("reader@openspock.org", "password", "", "", ""), ErrInvalid},
+		{"invalid token", d.AuthorizeToken("token", "/data/none", ActionRead), ErrBadCredentials},
+		{"lookup of an unknown user", lookupUser, ErrNotFound},
+		{"lookup of an unknown role", lookupRole, ErrNotFound},
+		{"disabled account", errAccountDisabled, ErrAccountRefused},
+		{"read-only location", errReadOnly, ErrStorage},
+	}
+	for _, tt := range tests {
+		if !errors.Is(tt.err, tt.kind) {
+			t.Errorf("%s: expected an error of kind %v, got %v", tt.name, tt.kind, tt.err)
+		}
+	}
+	if errors.Is(errAccountLocked, ErrBadCredentials) {
+		t.Error("errors should only match their own kind")
+	}
+}
@@ -0,0 +1,173 @@
+package user
+
+import (
+	"time"
+
+	"github.com/openspock/log"
+)
+
+// Explanation explains the authorization of an action on a resource for a
+// user, see Explain.
+type Explanation struct {
+	Email    string
+	Resource string
+	Action   string
+	Allowed  bool
+	// Pattern is the resource pattern of the file permissions which decided,
+	// if any.
+	Pattern string `json:",omitempty"`
+	// Grants are all file permissions whose resource pattern matches the
+	// resource and which are granted to the user, their groups, a role or
+	// everyone, most specific first.
+	Grants []GrantExplanation `json:",omitempty"`
+}
+
+// GrantExplanation explains why a file permission decided an authorization
+// or why it did not.
+type GrantExplanation struct {
+	FilePermission
+	// Grantee is who the file permission is granted to, for e.g.
+	// user ada@openspock.org, group finance, role analyst or everyone.
+	Grantee string
+	// Applies is set if the user is a grantee, i.e. unless the file
+	// permission is granted to a role they do not hold.
+	Applies bool
+	// Decisive is set if the file permission decided the authorization.
+	Decisive bool
+	Reason   string
+}
+
+// Explain explains the authorization of an action on a resource for a user
+// without authenticating them. The error is the one Authorize returns once
+// the user is authenticated.
+func (d *Directory) Explain(email, resource, action string) (Explanation, error) {
+	log.Info("Explain", log.AppMsg, map[string]interface{}{"email": email, "resource": resource, "action": action})
+
+	return d.snapshot().explain(email, resource, action)
+}
+
+// Redacted returns the explanation without the file permissions of roles the
+// user does not hold, for callers who may only learn about their own access.
+func (e Explanation) Redacted() Explanation {
+	grants := make([]GrantExplanation, 0, len(e.Grants))
+	for _, g := range e.Grants {
+		if g.Applies {
+			grants = append(grants, g)
+		}
+	}
+	e.Grants = grants
+	return e
+}
+
+// explain evaluates every file permission whose resource pattern matches
+// resource on its own - it applies if the user holds its role and it hasn't
+// expired. Of the applicable grants which allow the action, those with the
+// most specific pattern decide, regardless of whether they are granted to the
+// user, a group or a role, see moreSpecific. Grants which don't allow the
+// action are passed over, so that a narrow read grant doesn't take away a
+// broader write grant. The most specific applicable deny of the action
+// overrides them, unless their pattern is more specific.
+func (t *tables) explain(email, resource, action string) (Explanation, error) {
+	e := Explanation{Email: email, Resource: resource, Action: action}
+	u, ok := t.users[email]
+	if !ok {
+		return e, newError(ErrNotFound, email+" does not exist")
+	}
+	roles := t.effectiveRoles(u)
+	grantees := append(append([]string{u.UserID}, groupGrantees(u.Groups)...), "")
+	fps := t.matchFPs(resource, grantees...)
+
+	now := time.Now()
+	applies := make([]bool, len(fps))
+	var allowed, denied, granted, roleMismatch, expired bool
+	var grantPattern, denyPattern string
+	e.Grants = make([]GrantExplanation, len(fps))
+	for i, fp := range fps {
+		g := &e.Grants[i]
+		g.FilePermission = fp
+		switch {
+		case fp.Group != "":
+			g.Grantee = "group " + fp.Group
+		case fp.UserID != "":
+			g.Grantee = "user " + email
+		case fp.Role.RoleID != "":
+			g.Grantee = "role " + roleName(fp.Role)
+		default:
+			g.Grantee = "everyone"
+		}
+		g.Applies = fp.Role.RoleID == "" || roles[fp.Role.RoleID]
+
+		switch {
+		case fp.Role.RoleID != "" && !roles[fp.Role.RoleID]:
+			g.Reason = "applies to role " + roleName(fp.Role) + ", which " + email + " does not hold"
+			roleMismatch = roleMismatch || !fp.Deny
+		case !now.Before(fp.Expiration):
+			g.Reason = "expired " + fp.Expiration.Format(time.RFC3339)
+			expired = expired || !fp.Deny
+		case !fp.covers(action):
+			g.Reason = "does not allow " + action
+			if fp.Deny {
+				g.Reason = "does not deny " + action
+			}
+			granted = granted || !fp.Deny
+		default:
+			applies[i] = true
+			if fp.Deny && !denied {
+				denied, denyPattern = true, fp.File
+			} else if !fp.Deny && !allowed {
+				allowed, grantPattern = true, fp.File
+			}
+		}
+	}
+
+	denies := denied && (!allowed || !moreSpecific(grantPattern, denyPattern))
+	e.Allowed = allowed && !denies
+	if denies {
+		e.Pattern = denyPattern
+	} else if allowed {
+		e.Pattern = grantPattern
+	}
+
+	for i, fp := range fps {
+		if !applies[i] {
+			continue
+		}
+		g := &e.Grants[i]
+		switch {
+		case fp.Deny && !denies:
+			g.Reason = "overridden by the more specific grant for " + grantPattern
+		case fp.Deny && fp.File != denyPattern:
+			g.Reason = "overridden by the more specific deny for " + denyPattern
+		case fp.Deny:
+			g.Decisive, g.Reason = true, "denies "+action
+		case fp.File != grantPattern:
+			g.Reason = "overridden by the more specific grant for " + grantPattern
+		case denies:
+			g.Reason = "overridden by the deny for " + denyPattern
+		default:
+			g.Decisive, g.Reason = true, "allows "+action
+		}
+	}
+
+	switch {
+	case denies:
+		return e, newError(ErrNotAuthorized, resource+" permission denies "+action+" for "+email+" by "+denyPattern)
+	case allowed:
+		return e, nil
+	case granted:
+		return e, newError(ErrNotAuthorized, resource+" permission does not allow "+action+" for "+email)
+	case expired:
+		return e, newError(ErrPermissionExpired, "file permission expired")
+	case roleMismatch:
+		return e, newError(ErrRoleMismatch, "user does not have required role")
+	}
+	return e, newError(ErrNotAuthorized, resource+" permission does not exist for "+email)
+}
+
+// roleName returns the name of a role, or its RoleID if it no longer exists.
+func roleName(r Role) string {
+	if r.Name == "" {
+		return r.RoleID
+	}
+	return r.Name
+}
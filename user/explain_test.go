@@ -0,0 +1,120 @@
+package user
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGrantsAreEvaluatedOnTheirOwn(t *testing.T) {
+	d, _ := openWithSettings(t, "")
+	if err := d.Initialize("admin@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	analyst, err := d.CreateRole("analyst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditor, err := d.CreateRole("auditor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateUser("ada@openspock.org", "password", "", analyst.RoleID); err != nil {
+		t.Fatal(err)
+	}
+	ada, _ := d.User("ada@openspock.org")
+	grant := func(resource string, user *User, role *Role, actions []string, expiration time.Time) {
+		if _, err := d.CreateFP(resource, user, role, actions, expiration); err != nil {
+			t.Fatal(err)
+		}
+	}
+	grant("/reports/**", &User{}, analyst, []string{ActionRead}, time.Now().Add(-time.Hour))
+	grant("/reports/**", &User{}, auditor, []string{ActionRead}, time.Now().Add(time.Hour))
+	grant("/data/**", &ada, &Role{}, []string{ActionWrite}, time.Now().Add(-time.Hour))
+	grant("/data/**", &User{}, analyst, []string{ActionRead}, time.Now().Add(time.Hour))
+
+	authorize := func(resource, action string) error {
+		return d.Authorize("ada@openspock.org", "password", "", resource, action)
+	}
+	if err := authorize("/reports/q3.csv", ActionRead); !errors.Is(err, ErrPermissionExpired) {
+		t.Errorf("an expired grant of a held role plus a grant of another role should not pass, got %v", err)
+	}
+	if err := authorize("/data/q3.csv", ActionRead); err != nil {
+		t.Errorf("grants of roles should apply next to expired grants of the user: %v", err)
+	}
+	if err := authorize("/data/q3.csv", ActionWrite); !errors.Is(err, ErrNotAuthorized) {
+		t.Errorf("an action of an expired grant should not be allowed by another grant, got %v", err)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	d, _ := openWithSettings(t, "")
+	if err := d.Initialize("admin@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	analyst, err := d.CreateRole("analyst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditor, err := d.CreateRole("auditor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateUser("ada@openspock.org", "password", "", analyst.RoleID); err != nil {
+		t.Fatal(err)
+	}
+	ada, _ := d.User("ada@openspock.org")
+	grant := func(resource string, user *User, role *Role, expiration time.Time) {
+		if _, err := d.CreateFP(resource, user, role, []string{ActionRead}, expiration); err != nil {
+			t.Fatal(err)
+		}
+	}
+	grant("/reports/**", &User{}, analyst, time.Now().Add(-time.Hour))
+	grant("/reports/**", &User{}, auditor, time.Now().Add(time.Hour))
+	grant("/data/**", &ada, &Role{}, time.Now().Add(-time.Hour))
+	grant("/data/**", &User{}, analyst, time.Now().Add(time.Hour))
+
+	e, err := d.Explain("ada@openspock.org", "/reports/q3.csv", ActionRead)
+	if !errors.Is(err, ErrPermissionExpired) || e.Allowed || len(e.Grants) != 2 {
+		t.Fatalf("expected two candidate grants which do not allow, got %+v, %v", e, err)
+	}
+	for _, g := range e.Grants {
+		expected := "applies to role auditor, which ada@openspock.org does not hold"
+		if g.Grantee == "role analyst" {
+			expected = "expired " + g.Expiration.Format(time.RFC3339)
+		}
+		if g.Reason != expected || g.Decisive {
+			t.Errorf("%s of %s: expected %q, got %q", g.File, g.Grantee, expected, g.Reason)
+		}
+	}
+
+	if redacted := e.Redacted(); len(redacted.Grants) != 1 || redacted.Grants[0].Grantee != "role analyst" {
+		t.Errorf("expected the grant of a role ada does not hold to be redacted, got %+v", redacted.Grants)
+	}
+
+	if _, err := d.DenyFP("/data/secret/**", &User{}, analyst, []string{AnyAction}, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	e, err = d.Explain("ada@openspock.org", "/data/secret/plans.txt", ActionRead)
+	if !errors.Is(err, ErrNotAuthorized) || e.Allowed || e.Pattern != "/data/secret/**" {
+		t.Fatalf("expected the deny to decide, got %+v, %v", e, err)
+	}
+	for _, g := range e.Grants {
+		var expected string
+		switch {
+		case g.Deny:
+			expected = "denies read"
+		case g.UserID != "":
+			expected = "expired " + g.Expiration.Format(time.RFC3339)
+		default:
+			expected = "overridden by the deny for /data/secret/**"
+		}
+		if g.Reason != expected || g.Decisive != g.Deny {
+			t.Errorf("%s of %s: expected %q, got %q", g.File, g.Grantee, expected, g.Reason)
+		}
+	}
+
+	if _, err := d.Explain("nobody@openspock.org", "/data/q3.csv", ActionRead); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected unknown users to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+// +build !windows
+
+package user
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/juju/fslock"
+)
+
+// syncDir flushes directory entries, for e.g. a rename, to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// lockShared acquires a shared lock on file, waiting at most timeout. Any
+// number of shared locks can be held at once but none while fslock holds an
+// exclusive lock on the same file.
+func lockShared(file string, timeout time.Duration) (func() error, error) {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_RDONLY, 0644)
+	if os.IsPermission(err) {
+		// read only location, writers will have created the lock file
+		f, err = os.Open(file)
+		if os.IsNotExist(err) {
+			return func() error { return nil }, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+		if err == nil {
+			return f.Close, nil
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fslock.ErrTimeout
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
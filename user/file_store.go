@@ -0,0 +1,1019 @@
+package user
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/fslock"
+	"github.com/openspock/log"
+	"github.com/openspock/userd/config"
+)
+
+// LockTimeout is how long userd waits for other processes to release a
+// location before giving up.
+var LockTimeout = 30 * time.Second
+
+// lockPollInterval is how often a lock is retried while waiting for it.
+const lockPollInterval = 10 * time.Millisecond
+
+// autoCompactRows is the number of rows from which a conf file is compacted
+// as part of a commit, once at least half of them are superseded or deleted.
+// Authentications write the user, their sessions or API keys, without it the
+// conf files would grow with every login.
+var autoCompactRows = 1000
+
+// fileStore is the csv backed Store used for file:// locations.
+//
+// Users are stored in user.conf, roles in role.conf, file permissions in
+// filepermission.conf, sessions in session.conf, API keys in apikey.conf and certificate mappings
+// in certmapping.conf.
+// Every row is followed by a version and an operation
+// column:
+//
+//	<record fields>,<version>,put
+//	<record fields>,<version>,del
+//
+// For every key the row with the highest version wins, rows with the same
+// version are resolved in file order. A winning del row is a tombstone and
+// hides the record. Rows without version and operation columns were written
+// by older versions of userd and have version 0. A commit is versioned with
+// the time it is made at, but always later than the rows already written, so
+// that a clock going back can't make a write lose. Compact rewrites the conf
+// files down to their current state, commits do so once a conf file grew
+// large, see autoCompactRows.
+//
+// Writes are journaled. Apply first writes all rows of a commit to the
+// journal, then adds them to the conf files and finally removes the journal.
+// Recover replays a journal left behind by an interrupted Apply. Files are
+// never modified in place, they are written to a temporary file which is
+// synced and renamed over the original.
+//
+// A location is guarded by userd.lock. Writers hold an exclusive lock on it,
+// readers a shared one, both wait up to LockTimeout for the lock. Since the
+// lock file is independent of the conf files, it also guards their creation.
+type fileStore struct {
+	location string
+}
+
+// confFile is a conf file along with the schema of its records.
+type confFile struct {
+	schema
+	name string
+}
+
+const (
+	opPut    = "put"
+	opDelete = "del"
+
+	journalCommit = "commit"
+)
+
+// row is a single record of a conf file along with its version information.
+type row struct {
+	fields  []string
+	version int64
+	deleted bool
+}
+
+// journalEntry is a row which has to be added to a conf file.
+type journalEntry struct {
+	cf  confFile
+	row row
+}
+
+func newFileStore(location string) (*fileStore, error) {
+	if _, err := os.Stat(location); os.IsNotExist(err) {
+		os.Mkdir(location, os.ModeDir)
+		if err := os.Chmod(location, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &fileStore{location}, nil
+}
+
+func (s *fileStore) userConf() confFile {
+	return confFile{userSchema, s.location + config.GetUserConfFileName()}
+}
+
+func (s *fileStore) roleConf() confFile {
+	return confFile{roleSchema, s.location + config.GetRoleConfFileName()}
+}
+
+func (s *fileStore) filePermissionConf() confFile {
+	return confFile{filePermissionSchema, s.location + config.GetFPFileName()}
+}
+
+func (s *fileStore) sessionConf() confFile {
+	return confFile{sessionSchema, s.location + config.GetSessionConfFileName()}
+}
+
+func (s *fileStore) apiKeyConf() confFile {
+	return confFile{apiKeySchema, s.location + config.GetAPIKeyConfFileName()}
+}
+
+func (s *fileStore) certMappingConf() confFile {
+	return confFile{certMappingSchema, s.location + config.GetCertMappingConfFileName()}
+}
+
+func (s *fileStore) confFiles() []confFile {
+	return []confFile{s.userConf(), s.roleConf(), s.filePermissionConf(), s.sessionConf(), s.apiKeyConf(), s.certMappingConf()}
+}
+
+func (s *fileStore) journalFileName() string {
+	return s.location + config.GetJournalFileName()
+}
+
+func (s *fileStore) masterKeyFileName() string {
+	return s.location + config.GetMasterKeyFileName()
+}
+
+func (s *fileStore) lockFileName() string {
+	return s.location + config.GetLockFileName()
+}
+
+func (s *fileStore) settingsFileName() string {
+	return s.location + config.GetSettingsFileName()
+}
+
+func (s *fileStore) ReadUsers() ([]User, error) {
+	var users []User
+	err := s.read(s.userConf(), parseUser, func(_ string, val interface{}) {
+		users = append(users, val.(User))
+	})
+	return users, err
+}
+
+func (s *fileStore) ReadRoles() ([]Role, error) {
+	var roles []Role
+	err := s.read(s.roleConf(), parseRoles, func(_ string, val interface{}) {
+		roles = append(roles, val.(Role))
+	})
+	return roles, err
+}
+
+func (s *fileStore) ReadFPs() ([]FilePermission, error) {
+	var fps []FilePermission
+	err := s.read(s.filePermissionConf(), parseFilePermission, func(_ string, val interface{}) {
+		fps = append(fps, val.(FilePermission))
+	})
+	return fps, err
+}
+
+func (s *fileStore) ReadSessions() ([]Session, error) {
+	var sessions []Session
+	err := s.read(s.sessionConf(), parseSession, func(_ string, val interface{}) {
+		sessions = append(sessions, val.(Session))
+	})
+	return sessions, err
+}
+
+func (s *fileStore) ReadAPIKeys() ([]APIKey, error) {
+	var keys []APIKey
+	err := s.read(s.apiKeyConf(), parseAPIKeyRecord, func(_ string, val interface{}) {
+		keys = append(keys, val.(APIKey))
+	})
+	return keys, err
+}
+
+func (s *fileStore) ReadCertMappings() ([]CertMapping, error) {
+	var mappings []CertMapping
+	err := s.read(s.certMappingConf(), parseCertMapping, func(_ string, val interface{}) {
+		mappings = append(mappings, val.(CertMapping))
+	})
+	return mappings, err
+}
+
+// ReadSettings reads userd.conf. A location without userd.conf has default
+// settings.
+func (s *fileStore) ReadSettings() (Settings, error) {
+	f, err := os.Open(s.settingsFileName())
+	if os.IsNotExist(err) {
+		return Settings{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseSettings(s.settingsFileName(), f)
+}
+
+// WriteSettings atomically replaces userd.conf. Comments of the replaced file
+// are not kept.
+func (s *fileStore) WriteSettings(settings Settings) error {
+	lock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	return writeFile(s.settingsFileName(), settings.records(), 0644)
+}
+
+// Apply journals mutations and then adds them to the conf files. Once the
+// journal is in place the commit is durable, if userd is interrupted after
+// that the next Recover completes it.
+func (s *fileStore) Apply(mutations []Mutation) error {
+	lock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	return s.apply(mutations)
+}
+
+// Update reads the user with email, lets update change it and commits it
+// along with the mutations update returns. The exclusive lock is held
+// throughout, no other process can write the user in between.
+func (s *fileStore) Update(email string, update func(*User) ([]Mutation, error)) error {
+	return s.update(s.userConf(), parseUser, email, func(val interface{}) ([]Mutation, error) {
+		u := val.(User)
+		mutations, err := update(&u)
+		return append(mutations, Mutation{User: &u}), err
+	})
+}
+
+// UpdateRole is Update for the role with roleID.
+func (s *fileStore) UpdateRole(roleID string, update func(*Role) ([]Mutation, error)) error {
+	return s.update(s.roleConf(), parseRoles, roleID, func(val interface{}) ([]Mutation, error) {
+		r := val.(Role)
+		mutations, err := update(&r)
+		return append(mutations, Mutation{Role: &r}), err
+	})
+}
+
+// UpdateAPIKey is Update for the API key with keyID.
+func (s *fileStore) UpdateAPIKey(keyID string, update func(*APIKey) ([]Mutation, error)) error {
+	return s.update(s.apiKeyConf(), parseAPIKeyRecord, keyID, func(val interface{}) ([]Mutation, error) {
+		k := val.(APIKey)
+		mutations, err := update(&k)
+		return append(mutations, Mutation{APIKey: &k}), err
+	})
+}
+
+// update reads the current record of cf with key under the exclusive lock
+// and commits the mutations update returns for it.
+func (s *fileStore) update(cf confFile, handler parseRecord, key string, update func(interface{}) ([]Mutation, error)) error {
+	lock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	var current interface{}
+	err = s.read(cf, handler, func(k string, val interface{}) {
+		if k == key {
+			current = val
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return newError(ErrNotFound, key+" does not exist")
+	}
+	mutations, err := update(current)
+	if err != nil {
+		return err
+	}
+	return s.apply(mutations)
+}
+
+// apply commits mutations, see Apply. Callers hold the exclusive lock.
+func (s *fileStore) apply(mutations []Mutation) error {
+	if err := s.completeJournal(); err != nil {
+		return err
+	}
+	entries := make([]journalEntry, 0, len(mutations))
+	for _, m := range mutations {
+		r := row{deleted: m.Delete}
+		var cf confFile
+		switch {
+		case m.User != nil:
+			cf, r.fields = s.userConf(), userRecord(m.User)
+		case m.Role != nil:
+			cf, r.fields = s.roleConf(), roleRecord(m.Role)
+		case m.FP != nil:
+			cf, r.fields = s.filePermissionConf(), fpRecord(m.FP)
+		case m.Session != nil:
+			cf, r.fields = s.sessionConf(), sessionRecord(m.Session)
+		case m.APIKey != nil:
+			cf, r.fields = s.apiKeyConf(), apiKeyRecord(m.APIKey)
+		case m.CertMapping != nil:
+			cf, r.fields = s.certMappingConf(), certMappingRecord(m.CertMapping)
+		default:
+			return errors.New("mutation without record")
+		}
+		if err := s.seal(cf, []row{r}); err != nil {
+			return err
+		}
+		entries = append(entries, journalEntry{cf, r})
+	}
+	version, err := nextVersion(entries)
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		entries[i].row.version = version
+	}
+
+	if err := s.writeJournal(entries); err != nil {
+		return err
+	}
+	if err := s.replay(entries); err != nil {
+		return err
+	}
+	return s.removeJournal()
+}
+
+// nextVersion returns the version of a commit of entries. It is the current
+// time, unless a conf file written to already holds a row with that version
+// or a later one, for e.g. because the clock went back or another host with a
+// clock ahead wrote to the location. The commit then follows that row, so
+// that it still wins. Callers hold the exclusive lock, no other commit can
+// take the version.
+func nextVersion(entries []journalEntry) (int64, error) {
+	version := time.Now().UnixNano()
+	read := make(map[string]bool)
+	for _, e := range entries {
+		if read[e.cf.name] {
+			continue
+		}
+		read[e.cf.name] = true
+		rows, err := readRows(e.cf)
+		if err != nil {
+			return 0, err
+		}
+		for _, r := range rows {
+			if r.version >= version {
+				version = r.version + 1
+			}
+		}
+	}
+	return version, nil
+}
+
+// Compact rewrites every conf file with only its current records.
+func (s *fileStore) Compact() error {
+	lock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	if err := s.completeJournal(); err != nil {
+		return err
+	}
+
+	for _, cf := range s.confFiles() {
+		if _, err := os.Stat(cf.name); os.IsNotExist(err) {
+			continue
+		}
+		rows, err := readRows(cf)
+		if err != nil {
+			return err
+		}
+		if err := writeRows(cf, resolve(cf, rows)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Migrate upgrades conf files written with an older schema version in place.
+func (s *fileStore) Migrate() error {
+	for _, cf := range s.confFiles() {
+		_, version, err := readConf(cf)
+		if err != nil {
+			return err
+		}
+		if version == cf.version() {
+			continue
+		}
+
+		if err := s.migrate(cf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileStore) migrate(cf confFile) error {
+	lock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	rows, version, err := readConf(cf)
+	if err != nil {
+		return err
+	}
+	if version == cf.version() {
+		return nil
+	}
+	if err := s.seal(cf, rows); err != nil {
+		return err
+	}
+	if err := writeRows(cf, rows); err != nil {
+		return err
+	}
+	log.Info("Migrate", log.AppMsg, map[string]interface{}{"file": cf.name, "from": version, "to": cf.version(), "result": "success", "message": cf.name + " has been migrated"})
+	return nil
+}
+
+// RotateKey generates a new master key and re-encrypts all records with it.
+// The previous key is kept until every conf file has been rewritten.
+func (s *fileStore) RotateKey() error {
+	lock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	if err := s.completeJournal(); err != nil {
+		return err
+	}
+
+	kr, err := loadKeyring(s.masterKeyFileName())
+	if err != nil {
+		return err
+	}
+	if err := kr.generate(); err != nil {
+		return err
+	}
+	if err := kr.save(); err != nil {
+		return err
+	}
+
+	for _, cf := range s.confFiles() {
+		if len(cf.sensitive) == 0 {
+			continue
+		}
+		if _, err := os.Stat(cf.name); os.IsNotExist(err) {
+			continue
+		}
+		rows, err := readRows(cf)
+		if err != nil {
+			return err
+		}
+		if err := sealRows(kr, cf, rows); err != nil {
+			return err
+		}
+		if err := writeRows(cf, rows); err != nil {
+			return err
+		}
+	}
+
+	kr.keys = kr.keys[:1]
+	return kr.save()
+}
+
+// keyring loads the master keys if cf has fields which are encrypted at
+// rest.
+func (s *fileStore) keyring(cf confFile) (*keyring, error) {
+	if len(cf.sensitive) == 0 {
+		return &keyring{}, nil
+	}
+	return loadKeyring(s.masterKeyFileName())
+}
+
+// seal encrypts the sensitive fields of rows with the current master key.
+func (s *fileStore) seal(cf confFile, rows []row) error {
+	kr, err := s.keyring(cf)
+	if err != nil {
+		return err
+	}
+	return sealRows(kr, cf, rows)
+}
+
+// sealRows encrypts the sensitive fields of rows which aren't encrypted with
+// the current key of kr yet.
+func sealRows(kr *keyring, cf confFile, rows []row) error {
+	for _, r := range rows {
+		for _, i := range cf.sensitive {
+			if kr.isSealed(r.fields[i]) {
+				continue
+			}
+			plain, err := kr.open(r.fields[i])
+			if err != nil {
+				return fmt.Errorf("%s: %s: %v", cf.name, cf.key(r.fields), err)
+			}
+			if r.fields[i], err = kr.seal(plain); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Recover replays the journal of an interrupted Apply and removes temporary
+// files left behind.
+func (s *fileStore) Recover() error {
+	if _, err := os.Stat(s.journalFileName()); os.IsNotExist(err) {
+		return nil
+	}
+	lock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	// the journal belonged to a write which completed while we were waiting
+	if _, err := os.Stat(s.journalFileName()); os.IsNotExist(err) {
+		return nil
+	}
+	if err := s.completeJournal(); err != nil {
+		return err
+	}
+
+	temps, err := filepath.Glob(filepath.Join(s.location, "*.tmp*"))
+	if err != nil {
+		return err
+	}
+	for _, tmp := range temps {
+		os.Remove(tmp)
+	}
+	return nil
+}
+
+// completeJournal replays and removes a journal left behind by an interrupted
+// commit, if there is one. Callers hold the exclusive lock. Every write
+// completes it first, a new journal would replace it and the commit would
+// stay half applied.
+func (s *fileStore) completeJournal() error {
+	if _, err := os.Stat(s.journalFileName()); os.IsNotExist(err) {
+		return nil
+	}
+	entries, err := s.readJournal()
+	if err != nil {
+		return err
+	}
+	if err := s.replay(entries); err != nil {
+		return err
+	}
+	return s.removeJournal()
+}
+
+// RLock acquires a shared lock on this location.
+func (s *fileStore) RLock() (func() error, error) {
+	unlock, err := lockShared(s.lockFileName(), LockTimeout)
+	if err != nil {
+		return nil, s.lockError(err)
+	}
+	return unlock, nil
+}
+
+// lock acquires the exclusive lock guarding writes to this location.
+func (s *fileStore) lock() (*fslock.Lock, error) {
+	lock := fslock.New(s.lockFileName())
+	if err := lock.LockWithTimeout(LockTimeout); err != nil {
+		return nil, s.lockError(err)
+	}
+	return lock, nil
+}
+
+func (s *fileStore) lockError(err error) error {
+	if err == fslock.ErrTimeout {
+		return errors.New("timed out after " + LockTimeout.String() + " waiting for lock on " + s.location)
+	}
+	return err
+}
+
+// writeJournal durably writes entries to the journal. The journal ends with a
+// commit row holding the number of entries.
+func (s *fileStore) writeJournal(entries []journalEntry) error {
+	records := make([][]string, 0, len(entries)+1)
+	for _, e := range entries {
+		records = append(records, append([]string{e.cf.kind}, e.row.record()...))
+	}
+	records = append(records, []string{journalCommit, strconv.Itoa(len(entries))})
+	return writeFile(s.journalFileName(), records, 0644)
+}
+
+// readJournal reads the entries of the journal. Since the journal is renamed
+// into place only once it is complete, a journal without a matching commit
+// row is corrupt.
+func (s *fileStore) readJournal() ([]journalEntry, error) {
+	f, err := os.Open(s.journalFileName())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	confFiles := make(map[string]confFile)
+	for _, cf := range s.confFiles() {
+		confFiles[cf.kind] = cf
+	}
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 || records[len(records)-1][0] != journalCommit {
+		return nil, errors.New(s.journalFileName() + ": missing commit")
+	}
+	commit := records[len(records)-1]
+	if len(commit) != 2 {
+		return nil, fmt.Errorf("%s: commit has %d fields, expected 2", s.journalFileName(), len(commit))
+	}
+	if n, err := strconv.Atoi(commit[1]); err != nil || n != len(records)-1 {
+		return nil, errors.New(s.journalFileName() + ": commit does not match entries")
+	}
+
+	entries := make([]journalEntry, 0, len(records)-1)
+	for _, record := range records[:len(records)-1] {
+		cf, ok := confFiles[record[0]]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown conf file %q", s.journalFileName(), record[0])
+		}
+		r, err := cf.parseRow(record[1:], cf.version())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", s.journalFileName(), err)
+		}
+		entries = append(entries, journalEntry{cf, r})
+	}
+	return entries, nil
+}
+
+func (s *fileStore) removeJournal() error {
+	if err := os.Remove(s.journalFileName()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return syncDir(s.location)
+}
+
+// replay adds journal entries to their conf files. Rows which are already
+// present are skipped so a journal can be replayed more than once. Conf files
+// which grew past autoCompactRows are compacted, see autoCompactRows.
+func (s *fileStore) replay(entries []journalEntry) error {
+	var order []confFile
+	pending := make(map[string][]row)
+	for _, e := range entries {
+		if _, ok := pending[e.cf.name]; !ok {
+			order = append(order, e.cf)
+		}
+		pending[e.cf.name] = append(pending[e.cf.name], e.row)
+	}
+
+	for _, cf := range order {
+		rows, err := readRows(cf)
+		if err != nil {
+			return err
+		}
+		present := make(map[string]bool, len(rows))
+		for _, r := range rows {
+			present[r.String()] = true
+		}
+		for _, r := range pending[cf.name] {
+			if !present[r.String()] {
+				rows = append(rows, r)
+			}
+		}
+		if len(rows) >= autoCompactRows {
+			if current := resolve(cf, rows); len(current)*2 <= len(rows) {
+				rows = current
+			}
+		}
+		if err := writeRows(cf, rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read parses the current records of a conf file. A file that does not exist
+// yet is treated as empty.
+func (s *fileStore) read(cf confFile, handler parseRecord, insert func(string, interface{})) error {
+	rows, err := readRows(cf)
+	if err != nil {
+		return err
+	}
+	kr, err := s.keyring(cf)
+	if err != nil {
+		return err
+	}
+	return decodeRows(cf, rows, kr, handler, insert)
+}
+
+// decodeRows decrypts and parses the current records of rows.
+func decodeRows(cf confFile, rows []row, kr *keyring, handler parseRecord, insert func(string, interface{})) error {
+	var err error
+	for _, r := range resolve(cf, rows) {
+		for _, i := range cf.sensitive {
+			if r.fields[i], err = kr.open(r.fields[i]); err != nil {
+				return fmt.Errorf("%s: %s: %v", cf.name, cf.key(r.fields), err)
+			}
+		}
+		u, key, err := handler(r.fields)
+		if err != nil {
+			return err
+		}
+		insert(key, u)
+	}
+	return nil
+}
+
+// writeRows atomically replaces a conf file with rows in the current schema
+// version.
+func writeRows(cf confFile, rows []row) error {
+	records := make([][]string, 0, len(rows)+1)
+	records = append(records, cf.header())
+	for _, r := range rows {
+		records = append(records, r.record())
+	}
+	return writeFile(cf.name, records, 0644)
+}
+
+// writeFile atomically replaces file with records. The records are written to
+// a temporary file in the same directory which is synced and then renamed
+// over file.
+func writeFile(file string, records [][]string, perm os.FileMode) error {
+	dir := filepath.Dir(file)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := csv.NewWriter(tmp)
+	if err := w.WriteAll(records); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// readRows reads every row of a conf file in file order. Rows written with
+// an older schema version are upgraded to the current one.
+func readRows(cf confFile) ([]row, error) {
+	rows, _, err := readConf(cf)
+	return rows, err
+}
+
+// readConf reads every row of a conf file along with the schema version the
+// file was written with.
+func readConf(cf confFile) ([]row, int, error) {
+	config, err := os.Open(cf.name)
+	if os.IsNotExist(err) {
+		return nil, cf.version(), nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer config.Close()
+	return parseConf(cf, config)
+}
+
+// parseConf parses the rows of a conf file from in along with the schema
+// version they were written with.
+func parseConf(cf confFile, in io.Reader) ([]row, int, error) {
+	var rows []row
+	version := 1
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = -1
+	for first := true; ; first = false {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		line, _ := r.FieldPos(0)
+		if first && record[0] == schemaHeader {
+			if version, err = cf.parseHeader(record); err != nil {
+				return nil, 0, fmt.Errorf("%s:%d: %v", cf.name, line, err)
+			}
+			continue
+		}
+		parsed, err := cf.parseRow(record, version)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s:%d: %v", cf.name, line, err)
+		}
+		rows = append(rows, parsed)
+	}
+	return rows, version, nil
+}
+
+// resolve applies last write wins to rows and drops deleted records. The
+// current records are returned in the order their keys first appeared.
+func resolve(cf confFile, rows []row) []row {
+	var keys []string
+	current := make(map[string]row)
+	for _, r := range rows {
+		key := cf.key(r.fields)
+		c, ok := current[key]
+		if !ok {
+			keys = append(keys, key)
+		}
+		if !ok || r.version >= c.version {
+			current[key] = r
+		}
+	}
+
+	resolved := make([]row, 0, len(keys))
+	for _, key := range keys {
+		if r := current[key]; !r.deleted {
+			resolved = append(resolved, r)
+		}
+	}
+	return resolved
+}
+
+func (r row) record() []string {
+	op := opPut
+	if r.deleted {
+		op = opDelete
+	}
+	return append(append([]string(nil), r.fields...), strconv.FormatInt(r.version, 10), op)
+}
+
+func (r row) String() string {
+	return strings.Join(r.record(), "\x00")
+}
+
+// records for User, FilePermission and Role
+
+func userRecord(u *User) []string {
+	secret := base64.StdEncoding.EncodeToString([]byte(u.secret))
+	hash := base64.StdEncoding.EncodeToString([]byte(u.hash))
+	var lastFailure string
+	if !u.attempts.last.IsZero() {
+		lastFailure = u.attempts.last.Format(time.RFC3339Nano)
+	}
+	return []string{u.UserID, secret, u.Salt, hash, u.Email, u.Description, u.Since.Format(time.RFC3339), u.RoleID, strings.Join(u.history, " "), strconv.Itoa(u.attempts.failures), lastFailure,
+		strconv.FormatBool(u.RequireTOTP), u.totp.secret, strings.Join(u.totp.recoveryCodes, " "), strconv.FormatInt(u.totp.step, 10), strconv.FormatBool(u.Service),
+		u.reset.hash, formatOptionalTime(u.reset.expires), u.Status.String(), formatOptionalTime(u.Expires), strings.Join(u.Roles, " "), strings.Join(u.Groups, " ")}
+}
+
+func roleRecord(r *Role) []string {
+	return []string{r.RoleID, r.Name, strconv.FormatBool(r.RequireTOTP), strings.Join(r.Parents, " ")}
+}
+
+func fpRecord(fp *FilePermission) []string {
+	return []string{fp.File, fp.UserID, fp.Role.RoleID, fp.Assignment.Format(time.RFC3339), fp.Expiration.Format(time.RFC3339), strings.Join(fp.Actions, " "), fp.Group, strconv.FormatBool(fp.Deny)}
+}
+
+func sessionRecord(session *Session) []string {
+	secret := base64.StdEncoding.EncodeToString([]byte(session.secret))
+	return []string{session.SessionID, session.Email, session.Source, session.Issued.Format(time.RFC3339Nano), session.Expires.Format(time.RFC3339Nano), secret}
+}
+
+func apiKeyRecord(k *APIKey) []string {
+	return []string{k.KeyID, k.Account, k.Description, k.Created.Format(time.RFC3339), formatOptionalTime(k.Expires), formatOptionalTime(k.LastUsed), k.hash}
+}
+
+func certMappingRecord(m *CertMapping) []string {
+	return []string{m.Identity, m.Email}
+}
+
+// formatOptionalTime formats t, the zero time is left empty.
+func formatOptionalTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// parsing logic for User, FilePermission, Role, Session, APIKey and
+// CertMapping
+
+type parseRecord func([]string) (interface{}, string, error)
+
+func parseUser(record []string) (interface{}, string, error) {
+	createdTime, err := time.Parse(time.RFC3339, record[6])
+	if err != nil {
+		return User{}, "", err
+	}
+	secret, err := base64.StdEncoding.DecodeString(record[1])
+	if err != nil {
+		return User{}, "", err
+	}
+	hash, err := base64.StdEncoding.DecodeString(record[3])
+	if err != nil {
+		return User{}, "", err
+	}
+	var a attempts
+	if a.failures, err = strconv.Atoi(record[9]); err != nil {
+		return User{}, "", err
+	}
+	if record[10] != "" {
+		if a.last, err = time.Parse(time.RFC3339Nano, record[10]); err != nil {
+			return User{}, "", err
+		}
+	}
+	requireTOTP, err := strconv.ParseBool(record[11])
+	if err != nil {
+		return User{}, "", err
+	}
+	totp := totpState{secret: record[12], recoveryCodes: strings.Fields(record[13])}
+	if totp.step, err = strconv.ParseInt(record[14], 10, 64); err != nil {
+		return User{}, "", err
+	}
+	service, err := strconv.ParseBool(record[15])
+	if err != nil {
+		return User{}, "", err
+	}
+	reset := resetToken{hash: record[16]}
+	if reset.expires, err = parseOptionalTime(record[17]); err != nil {
+		return User{}, "", err
+	}
+	status, err := parseStatus(record[18])
+	if err != nil {
+		return User{}, "", err
+	}
+	expires, err := parseOptionalTime(record[19])
+	if err != nil {
+		return User{}, "", err
+	}
+	u := User{record[0], string(secret), record[2], string(hash), record[4], record[5], createdTime, record[7], strings.Fields(record[20]), strings.Fields(record[21]), requireTOTP, service, status, expires, strings.Fields(record[8]), a, totp, reset}
+	return u, u.Email, nil
+}
+
+func parseRoles(record []string) (interface{}, string, error) {
+	requireTOTP, err := strconv.ParseBool(record[2])
+	if err != nil {
+		return Role{}, "", err
+	}
+	return Role{record[0], record[1], requireTOTP, strings.Fields(record[3])}, record[0], nil
+}
+
+func parseFilePermission(record []string) (interface{}, string, error) {
+	assignment, err := time.Parse(time.RFC3339, record[3])
+	if err != nil {
+		return FilePermission{}, "", err
+	}
+	expiration, err := time.Parse(time.RFC3339, record[4])
+	if err != nil {
+		return FilePermission{}, "", err
+	}
+	deny, err := strconv.ParseBool(record[7])
+	if err != nil {
+		return FilePermission{}, "", err
+	}
+	return FilePermission{record[0], record[1], Role{RoleID: record[2]}, assignment, expiration, strings.Fields(record[5]), record[6], deny}, record[1], nil
+}
+
+func parseSession(record []string) (interface{}, string, error) {
+	issued, err := time.Parse(time.RFC3339Nano, record[3])
+	if err != nil {
+		return Session{}, "", err
+	}
+	expires, err := time.Parse(time.RFC3339Nano, record[4])
+	if err != nil {
+		return Session{}, "", err
+	}
+	secret, err := base64.StdEncoding.DecodeString(record[5])
+	if err != nil {
+		return Session{}, "", err
+	}
+	return Session{record[0], record[1], record[2], issued, expires, string(secret)}, record[0], nil
+}
+
+func parseAPIKeyRecord(record []string) (interface{}, string, error) {
+	created, err := time.Parse(time.RFC3339, record[3])
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	expires, err := parseOptionalTime(record[4])
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	lastUsed, err := parseOptionalTime(record[5])
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	return APIKey{record[0], record[1], record[2], created, expires, lastUsed, record[6]}, record[0], nil
+}
+
+func parseCertMapping(record []string) (interface{}, string, error) {
+	return CertMapping{record[0], record[1]}, record[0], nil
+}
+
+// parseOptionalTime parses a time formatted by formatOptionalTime.
+func parseOptionalTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,234 @@
+package user
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecoverReplaysJournal(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Role{RoleID: "journal-role", Name: "journal"}
+	u := &User{UserID: "journal-user", Email: "journal@openspock.org", RoleID: r.RoleID}
+	entries := []journalEntry{
+		{s.roleConf(), row{fields: roleRecord(r), version: 1}},
+		{s.userConf(), row{fields: userRecord(u), version: 1}},
+	}
+	// simulate a crash after the journal has been written
+	if err := s.writeJournal(entries); err != nil {
+		t.Fatal(err)
+	}
+	// the first entry already made it to its conf file
+	if err := s.replay(entries[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(s.journalFileName()); !os.IsNotExist(err) {
+		t.Error("journal should have been removed")
+	}
+	if _, ok := d.User("journal@openspock.org"); !ok {
+		t.Error("journaled user should have been recovered")
+	}
+	rows, err := readRows(s.roleConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 {
+		t.Errorf("journaled role should be written exactly once, got %d rows", len(rows))
+	}
+}
+
+func TestPendingJournalIsCompleted(t *testing.T) {
+	dir := t.TempDir()
+	d, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := storeSignature(d.config.Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another process crashed after writing the role of its commit
+	s := d.config.Store.(*fileStore)
+	r := &Role{RoleID: "journal-role", Name: "journal"}
+	u := &User{UserID: "journal-user", Email: "journal@openspock.org", RoleID: r.RoleID}
+	entries := []journalEntry{
+		{s.roleConf(), row{fields: roleRecord(r), version: 1}},
+		{s.userConf(), row{fields: userRecord(u), version: 1}},
+	}
+	if err := s.writeJournal(entries); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := storeSignature(s); err != nil || changed == signature {
+		t.Errorf("expected a pending journal to change the signature, got %v", err)
+	}
+	if err := s.replay(entries[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Apply([]Mutation{{Role: &Role{RoleID: "other-role", Name: "other"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(s.journalFileName()); !os.IsNotExist(err) {
+		t.Error("the next write should have removed both journals")
+	}
+	users, err := s.ReadUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Email != u.Email {
+		t.Errorf("the next write should complete the pending commit, got users %v", users)
+	}
+}
+
+func TestRecoverFailsForCorruptJournal(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(s.journalFileName(), [][]string{{"role", "journal-role", "journal", "1", opPut}}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open("file://" + dir); err == nil {
+		t.Error("journal without commit should fail recovery")
+	}
+
+	// a truncated commit row
+	if err := writeFile(s.journalFileName(), [][]string{{"role", "journal-role", "journal", "1", opPut}, {journalCommit}}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Recover(); err == nil || !strings.Contains(err.Error(), "commit has 1 fields") {
+		t.Errorf("journal with a truncated commit should fail recovery, got %v", err)
+	}
+}
+
+func TestInitialize(t *testing.T) {
+	d, err := Open("file://" + t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Initialize("admin@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AuthenticateForRole("admin@openspock.org", "password", "", Admin); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestApplyWaitsForLock(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock, err := s.lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		lock.Unlock()
+	}()
+	if err := s.Apply([]Mutation{{Role: &Role{RoleID: "lock-role", Name: "lock"}}}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestApplyTimesOutWhileReadLocked(t *testing.T) {
+	defer func(timeout time.Duration) { LockTimeout = timeout }(LockTimeout)
+	LockTimeout = 50 * time.Millisecond
+
+	dir := t.TempDir()
+	s, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := s.RLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	unlock2, err := s.RLock()
+	if err != nil {
+		t.Fatalf("shared locks should not exclude each other: %v", err)
+	}
+	defer unlock2()
+	if err := s.Apply([]Mutation{{Role: &Role{RoleID: "lock-role", Name: "lock"}}}); err == nil {
+		t.Error("Apply should time out while a reader holds the lock")
+	}
+}
+
+func TestApplyWinsOverRowsFromTheFuture(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a host with a clock an hour ahead wrote the role
+	r := &Role{RoleID: "clock-role", Name: "ahead"}
+	ahead := time.Now().Add(time.Hour).UnixNano()
+	if err := writeRows(s.roleConf(), []row{{fields: roleRecord(r), version: ahead}}); err != nil {
+		t.Fatal(err)
+	}
+
+	r.Name = "behind"
+	if err := s.Apply([]Mutation{{Role: r}}); err != nil {
+		t.Fatal(err)
+	}
+	roles, err := s.ReadRoles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 1 || roles[0].Name != "behind" {
+		t.Errorf("the later write should win regardless of the clock, got %v", roles)
+	}
+	rows, err := readRows(s.roleConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows[len(rows)-1].version <= ahead {
+		t.Errorf("expected a version after %d, got %d", ahead, rows[len(rows)-1].version)
+	}
+}
+
+func TestApplyCompactsLargeConfFiles(t *testing.T) {
+	defer func(rows int) { autoCompactRows = rows }(autoCompactRows)
+	autoCompactRows = 10
+
+	s, err := newFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 25; i++ {
+		r := &Role{RoleID: "compact-role", Name: "compact" + strconv.Itoa(i)}
+		if err := s.Apply([]Mutation{{Role: r}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows, err := readRows(s.roleConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) >= 10 {
+		t.Errorf("expected role.conf to be compacted, got %d rows", len(rows))
+	}
+	roles, err := s.ReadRoles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 1 || roles[0].Name != "compact24" {
+		t.Errorf("expected only the last write to remain, got %+v", roles)
+	}
+}
@@ -0,0 +1,25 @@
+// +build windows
+
+package user
+
+import (
+	"time"
+
+	"github.com/juju/fslock"
+)
+
+// syncDir is a no-op on windows, directories can't be synced and NTFS
+// journals metadata changes such as renames.
+func syncDir(dir string) error {
+	return nil
+}
+
+// lockShared falls back to an exclusive lock on windows, readers are
+// serialized but still never overlap with a writer.
+func lockShared(file string, timeout time.Duration) (func() error, error) {
+	lock := fslock.New(file)
+	if err := lock.LockWithTimeout(timeout); err != nil {
+		return nil, err
+	}
+	return lock.Unlock, nil
+}
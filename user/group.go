@@ -0,0 +1,136 @@
+package user
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/openspock/log"
+)
+
+// groupPattern matches group names, for e.g. finance or on-call.
+var groupPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// groupGrantee returns the grantee of file permissions granted to a group,
+// see grantee.
+func groupGrantee(group string) string {
+	return "group:" + group
+}
+
+func groupGrantees(groups []string) []string {
+	grantees := make([]string, 0, len(groups))
+	for _, g := range groups {
+		grantees = append(grantees, groupGrantee(g))
+	}
+	return grantees
+}
+
+func checkGroup(group string) error {
+	if !groupPattern.MatchString(group) {
+		return newError(ErrInvalid, "invalid group "+group+", group names are made of letters, digits, _, . and -")
+	}
+	return nil
+}
+
+// AddUserToGroup adds a user to a group. Groups exist as long as they have
+// members or file permissions.
+func (d *Directory) AddUserToGroup(email, group string) error {
+	log.Info("AddUserToGroup", log.AppMsg, map[string]interface{}{"email": email, "group": group})
+
+	if err := checkGroup(group); err != nil {
+		return err
+	}
+	if err := d.updateUser(email, func(u *User) error {
+		if contains(u.Groups, group) {
+			return newError(ErrExists, email+" already belongs to "+group)
+		}
+		u.Groups = append(u.Groups, group)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	log.Info("AddUserToGroup", log.AppMsg, map[string]interface{}{"email": email, "group": group, "result": "success", "message": email + " has been added to " + group})
+	return nil
+}
+
+// RemoveUserFromGroup removes a user from a group.
+func (d *Directory) RemoveUserFromGroup(email, group string) error {
+	log.Info("RemoveUserFromGroup", log.AppMsg, map[string]interface{}{"email": email, "group": group})
+
+	if err := d.updateUser(email, func(u *User) error {
+		if !contains(u.Groups, group) {
+			return newError(ErrNotFound, email+" does not belong to "+group)
+		}
+		u.Groups = remove(u.Groups, group)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	log.Info("RemoveUserFromGroup", log.AppMsg, map[string]interface{}{"email": email, "group": group, "result": "success", "message": email + " has been removed from " + group})
+	return nil
+}
+
+// GroupMembers returns the emails of the members of a group, sorted.
+func (d *Directory) GroupMembers(group string) []string {
+	var members []string
+	for _, u := range d.snapshot().users {
+		if contains(u.Groups, group) {
+			members = append(members, u.Email)
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+// CreateGroupFP creates a new file permission for a group which grants
+// actions on a resource to all its members. It replaces the actions of an
+// existing file permission for the same group.
+func (d *Directory) CreateGroupFP(file, group string, actions []string, expiration time.Time) (*FilePermission, error) {
+	log.Info("CreateGroupFP", log.AppMsg, map[string]interface{}{"file": file, "group": group, "actions": strings.Join(actions, ",")})
+
+	if err := checkGroup(group); err != nil {
+		return nil, err
+	}
+	fp, err := NewFP(file, User{}, Role{}, actions, expiration)
+	if err != nil {
+		return nil, err
+	}
+	fp.Group = group
+
+	if err := d.config.WriteFP(fp); err != nil {
+		return nil, err
+	}
+	if err := d.Reload(); err != nil {
+		return nil, err
+	}
+
+	log.Info("CreateGroupFP", log.AppMsg, map[string]interface{}{"file": file, "group": group, "result": "success", "message": "Permission for " + file + " has been created"})
+	return fp, nil
+}
+
+// RevokeGroupFP revokes the file permission for a resource granted to a
+// group.
+func (d *Directory) RevokeGroupFP(file, group string) error {
+	log.Info("RevokeGroupFP", log.AppMsg, map[string]interface{}{"file": file, "group": group})
+
+	fps := d.snapshot().fps[groupGrantee(group)][file]
+	if len(fps) == 0 {
+		return newError(ErrNotFound, file+" permission does not exist for "+group)
+	}
+	var mutations []Mutation
+	for i := range fps {
+		mutations = append(mutations, Mutation{FP: &fps[i], Delete: true})
+	}
+	if err := d.config.Apply(mutations...); err != nil {
+		return err
+	}
+	if err := d.Reload(); err != nil {
+		return err
+	}
+
+	log.Info("RevokeGroupFP", log.AppMsg, map[string]interface{}{"file": file, "group": group, "result": "success", "message": "Permission for " + file + " has been revoked"})
+	return nil
+}
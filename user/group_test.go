@@ -0,0 +1,125 @@
+package user
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGroupsAndMultipleRoles(t *testing.T) {
+	d, dir := openWithSettings(t, "")
+	if err := d.Initialize("admin@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	analyst, err := d.CreateRole("analyst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditor, err := d.CreateRole("auditor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateUser("grace@openspock.org", "password", "", analyst.RoleID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CreateFP("/audit/**", &User{}, auditor, []string{ActionRead}, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CreateGroupFP("/data/ledger/**", "finance", []string{ActionRead, ActionWrite}, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CreateGroupFP("/data", "not a group", []string{ActionRead}, time.Now().Add(time.Hour)); !errors.Is(err, ErrInvalid) {
+		t.Errorf("expected invalid group names to be rejected, got %v", err)
+	}
+
+	authorize := func(d *Directory, resource, action string) error {
+		return d.Authorize("grace@openspock.org", "password", "", resource, action)
+	}
+	if err := authorize(d, "/audit/2024.log", ActionRead); !errors.Is(err, ErrRoleMismatch) {
+		t.Errorf("expected grants of roles the user does not hold not to apply, got %v", err)
+	}
+	if err := d.AddUserRole("grace@openspock.org", auditor.RoleID); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddUserRole("grace@openspock.org", analyst.RoleID); !errors.Is(err, ErrExists) {
+		t.Errorf("expected a role the user already holds to be rejected, got %v", err)
+	}
+	if err := d.AddUserToGroup("grace@openspock.org", "finance"); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authorize(reopened, "/audit/2024.log", ActionRead); err != nil {
+		t.Errorf("grants of added roles should apply: %v", err)
+	}
+	if err := authorize(reopened, "/data/ledger/q3.csv", ActionWrite); err != nil {
+		t.Errorf("grants of groups should apply to their members: %v", err)
+	}
+	roles, err := reopened.EffectiveRoles("grace@openspock.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, r := range roles {
+		names = append(names, r.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"analyst", "auditor"}) {
+		t.Errorf("expected effective roles analyst and auditor, got %v", names)
+	}
+	if members := reopened.GroupMembers("finance"); !reflect.DeepEqual(members, []string{"grace@openspock.org"}) {
+		t.Errorf("expected grace to be the only member of finance, got %v", members)
+	}
+
+	if err := reopened.RemoveUserRole("grace@openspock.org", analyst.RoleID); !errors.Is(err, ErrInvalid) {
+		t.Errorf("expected the role a user was created with not to be removable, got %v", err)
+	}
+	if err := reopened.RemoveUserRole("grace@openspock.org", auditor.RoleID); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.RemoveUserFromGroup("grace@openspock.org", "finance"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.RemoveUserFromGroup("grace@openspock.org", "finance"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected removing a missing membership to fail, got %v", err)
+	}
+	if err := authorize(reopened, "/data/ledger/q3.csv", ActionRead); !errors.Is(err, ErrNotAuthorized) {
+		t.Errorf("grants of groups should no longer apply to former members, got %v", err)
+	}
+	if err := reopened.RevokeGroupFP("/data/ledger/**", "finance"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.RevokeGroupFP("/data/ledger/**", "finance"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected revoking a missing group grant to fail, got %v", err)
+	}
+}
+
+func TestAddedRoleRequiresTOTP(t *testing.T) {
+	d, _ := openWithSettings(t, "")
+	if err := d.Initialize("admin@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	analyst, err := d.CreateRole("analyst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateUser("grace@openspock.org", "password", "", analyst.RoleID); err != nil {
+		t.Fatal(err)
+	}
+	admin, err := d.GetRoleIDFor("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RequireRoleTOTP(admin, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddUserRole("grace@openspock.org", admin); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AuthenticateForRole("grace@openspock.org", "password", "", Admin); err != errSecondFactorRequired {
+		t.Errorf("expected an added role to require its second factor, got %v", err)
+	}
+}
@@ -0,0 +1,233 @@
+package user
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openspock/userd/config"
+)
+
+// HTTPCABundle is the path of a PEM encoded CA bundle used to verify https
+// locations. The system roots are used if it is empty.
+var HTTPCABundle string
+
+// HTTPMasterKeyFile is the path of the master key file used to decrypt users
+// read from http(s) locations. Leave it empty if the location doesn't encrypt
+// users.
+var HTTPMasterKeyFile string
+
+// HTTPTimeout bounds every request to an http(s) location.
+var HTTPTimeout = 30 * time.Second
+
+// errReadOnly is returned for writes to a read-only store.
+var errReadOnly = newError(ErrStorage, "location is read-only")
+
+// httpStore is a read-only Store for http:// and https:// locations. It
+// fetches the same conf files a fileStore writes, for e.g.
+//
+//	https://openspock.org/userd/user.conf
+//
+// so that agents on many hosts can read one central location. Responses are
+// cached along with their ETag and revalidated with If-None-Match.
+type httpStore struct {
+	url    string
+	client *http.Client
+}
+
+// cachedResponse is the body of a conf file and the ETag it was served with.
+type cachedResponse struct {
+	etag string
+	body []byte
+}
+
+var httpCache = struct {
+	sync.Mutex
+	m map[string]cachedResponse
+}{m: make(map[string]cachedResponse)}
+
+func newHTTPStore(url string) (*httpStore, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if HTTPCABundle != "" {
+		pem, err := ioutil.ReadFile(HTTPCABundle)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New(HTTPCABundle + " does not contain any certificates")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &httpStore{
+		url:    strings.TrimRight(url, "/"),
+		client: &http.Client{Transport: transport, Timeout: HTTPTimeout},
+	}, nil
+}
+
+func (s *httpStore) confFile(sc schema, name string) confFile {
+	return confFile{sc, s.url + "/" + strings.TrimLeft(name, `/\`)}
+}
+
+func (s *httpStore) ReadUsers() ([]User, error) {
+	var users []User
+	err := s.read(s.confFile(userSchema, config.GetUserConfFileName()), parseUser, func(_ string, val interface{}) {
+		users = append(users, val.(User))
+	})
+	return users, err
+}
+
+func (s *httpStore) ReadRoles() ([]Role, error) {
+	var roles []Role
+	err := s.read(s.confFile(roleSchema, config.GetRoleConfFileName()), parseRoles, func(_ string, val interface{}) {
+		roles = append(roles, val.(Role))
+	})
+	return roles, err
+}
+
+func (s *httpStore) ReadFPs() ([]FilePermission, error) {
+	var fps []FilePermission
+	err := s.read(s.confFile(filePermissionSchema, config.GetFPFileName()), parseFilePermission, func(_ string, val interface{}) {
+		fps = append(fps, val.(FilePermission))
+	})
+	return fps, err
+}
+
+func (s *httpStore) ReadSessions() ([]Session, error) {
+	var sessions []Session
+	err := s.read(s.confFile(sessionSchema, config.GetSessionConfFileName()), parseSession, func(_ string, val interface{}) {
+		sessions = append(sessions, val.(Session))
+	})
+	return sessions, err
+}
+
+func (s *httpStore) ReadAPIKeys() ([]APIKey, error) {
+	var keys []APIKey
+	err := s.read(s.confFile(apiKeySchema, config.GetAPIKeyConfFileName()), parseAPIKeyRecord, func(_ string, val interface{}) {
+		keys = append(keys, val.(APIKey))
+	})
+	return keys, err
+}
+
+func (s *httpStore) ReadCertMappings() ([]CertMapping, error) {
+	var mappings []CertMapping
+	err := s.read(s.confFile(certMappingSchema, config.GetCertMappingConfFileName()), parseCertMapping, func(_ string, val interface{}) {
+		mappings = append(mappings, val.(CertMapping))
+	})
+	return mappings, err
+}
+
+func (s *httpStore) ReadSettings() (Settings, error) {
+	url := s.confFile(schema{}, config.GetSettingsFileName()).name
+	body, err := s.fetch(url)
+	if err != nil {
+		return nil, err
+	}
+	return parseSettings(url, bytes.NewReader(body))
+}
+
+func (s *httpStore) WriteSettings(settings Settings) error {
+	return errReadOnly
+}
+
+func (s *httpStore) Apply(mutations []Mutation) error {
+	return errReadOnly
+}
+
+func (s *httpStore) Update(email string, update func(*User) ([]Mutation, error)) error {
+	return errReadOnly
+}
+
+func (s *httpStore) UpdateRole(roleID string, update func(*Role) ([]Mutation, error)) error {
+	return errReadOnly
+}
+
+func (s *httpStore) UpdateAPIKey(keyID string, update func(*APIKey) ([]Mutation, error)) error {
+	return errReadOnly
+}
+
+func (s *httpStore) Compact() error {
+	return errReadOnly
+}
+
+// Migrate is a no-op, rows of older schema versions are upgraded in memory
+// while reading.
+func (s *httpStore) Migrate() error {
+	return nil
+}
+
+// Recover is a no-op, the location is never written to.
+func (s *httpStore) Recover() error {
+	return nil
+}
+
+// RLock is a no-op, every conf file is fetched in a single response.
+func (s *httpStore) RLock() (func() error, error) {
+	return func() error { return nil }, nil
+}
+
+func (s *httpStore) read(cf confFile, handler parseRecord, insert func(string, interface{})) error {
+	body, err := s.fetch(cf.name)
+	if err != nil {
+		return err
+	}
+	rows, _, err := parseConf(cf, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	kr := &keyring{}
+	if len(cf.sensitive) > 0 && HTTPMasterKeyFile != "" {
+		if kr, err = loadKeyring(HTTPMasterKeyFile); err != nil {
+			return err
+		}
+	}
+	return decodeRows(cf, rows, kr, handler, insert)
+}
+
+// fetch gets the body of url, revalidating a cached response if there is
+// one. A conf file which does not exist is treated as empty.
+func (s *httpStore) fetch(url string) ([]byte, error) {
+	httpCache.Lock()
+	cached, ok := httpCache.m[url]
+	httpCache.Unlock()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if ok && cached.etag != "" {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		httpCache.Lock()
+		httpCache.m[url] = cachedResponse{resp.Header.Get("ETag"), body}
+		httpCache.Unlock()
+		return body, nil
+	case http.StatusNotModified:
+		if !ok {
+			return nil, errors.New(url + ": not modified but not cached")
+		}
+		return cached.body, nil
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, errors.New(url + ": " + resp.Status)
+	}
+}
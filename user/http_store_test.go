@@ -0,0 +1,81 @@
+package user
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestHTTPStore(t *testing.T) {
+	dir := t.TempDir()
+	local, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := local.Initialize("remote@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	var fetched, revalidated int
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info, err := os.Stat(filepath.Join(dir, filepath.Base(r.URL.Path)))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		etag := `"` + strconv.FormatInt(info.ModTime().UnixNano(), 10) + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			revalidated++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fetched++
+		w.Header().Set("ETag", etag)
+		http.ServeFile(w, r, filepath.Join(dir, filepath.Base(r.URL.Path)))
+	}))
+	defer srv.Close()
+
+	defer func(bundle, key string) { HTTPCABundle, HTTPMasterKeyFile = bundle, key }(HTTPCABundle, HTTPMasterKeyFile)
+	HTTPCABundle = filepath.Join(t.TempDir(), "ca.crt")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(HTTPCABundle, cert, 0644); err != nil {
+		t.Fatal(err)
+	}
+	HTTPMasterKeyFile = filepath.Join(dir, "master.key")
+
+	location := srv.URL + "/userd"
+	d, err := Open(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AuthenticateForRole("remote@openspock.org", "password", "", Admin); err != nil {
+		t.Fatal(err)
+	}
+	// filepermission.conf does not exist yet
+	if fetched != 2 {
+		t.Errorf("expected 2 conf files to be fetched, got %d", fetched)
+	}
+	if err := d.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Authenticate("remote@openspock.org", "password", ""); err != nil {
+		t.Fatal(err)
+	}
+	if fetched != 2 || revalidated != 2 {
+		t.Errorf("expected cached conf files to be revalidated, got %d fetched and %d revalidated", fetched, revalidated)
+	}
+
+	if _, err := d.CreateRole("remote-role"); err != errReadOnly {
+		t.Errorf("expected a read-only location, got %v", err)
+	}
+
+	HTTPCABundle = ""
+	if _, err := Open(location); err == nil {
+		t.Error("server certificate should not be trusted without the CA bundle")
+	}
+}
@@ -0,0 +1,166 @@
+package user
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+)
+
+// sealedPrefix marks an encrypted field value:
+//
+//	enc:<key id>:<base64 of nonce and ciphertext>
+//
+// Field values without the prefix were written before encryption at rest
+// and are read as plain text.
+const sealedPrefix = "enc:"
+
+// keyring holds the AES-256 master keys of a location, one key per row of the
+// key file:
+//
+//	<key id>,<base64 key>
+//
+// The first key encrypts, all keys decrypt. Keeping the previous key around
+// while rotating keeps every record readable if the rotation is interrupted.
+type keyring struct {
+	file string
+	keys []masterKey
+}
+
+type masterKey struct {
+	id  string
+	key []byte
+}
+
+// loadKeyring reads the key file. A key file which does not exist yet yields
+// an empty keyring.
+func loadKeyring(file string) (*keyring, error) {
+	k := &keyring{file: file}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, errors.New(file + ": " + err.Error())
+	}
+	for _, record := range records {
+		if len(record) != 2 {
+			return nil, errors.New(file + ": invalid key")
+		}
+		key, err := base64.StdEncoding.DecodeString(record[1])
+		if err != nil || len(key) != 32 {
+			return nil, errors.New(file + ": invalid key " + record[0])
+		}
+		k.keys = append(k.keys, masterKey{record[0], key})
+	}
+	return k, nil
+}
+
+// generate adds a new key which becomes the key used for encryption.
+func (k *keyring) generate() error {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	k.keys = append([]masterKey{{hex.EncodeToString(id), key}}, k.keys...)
+	return nil
+}
+
+// save atomically writes the key file, readable by its owner only.
+func (k *keyring) save() error {
+	records := make([][]string, 0, len(k.keys))
+	for _, m := range k.keys {
+		records = append(records, []string{m.id, base64.StdEncoding.EncodeToString(m.key)})
+	}
+	return writeFile(k.file, records, 0600)
+}
+
+// seal encrypts value with the current key, generating and saving the first
+// key if there is none yet.
+func (k *keyring) seal(value string) (string, error) {
+	if len(k.keys) == 0 {
+		if err := k.generate(); err != nil {
+			return "", err
+		}
+		if err := k.save(); err != nil {
+			return "", err
+		}
+	}
+	gcm, err := newGCM(k.keys[0].key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(value), []byte(k.keys[0].id))
+	return sealedPrefix + k.keys[0].id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a sealed value. Plain text values are returned as is.
+func (k *keyring) open(value string) (string, error) {
+	if !strings.HasPrefix(value, sealedPrefix) {
+		return value, nil
+	}
+	p := strings.SplitN(strings.TrimPrefix(value, sealedPrefix), ":", 2)
+	if len(p) != 2 {
+		return "", errors.New("invalid encrypted value")
+	}
+	var key []byte
+	for _, m := range k.keys {
+		if m.id == p[0] {
+			key = m.key
+		}
+	}
+	if key == nil && k.file == "" {
+		return "", errors.New("master key " + p[0] + " is not available")
+	}
+	if key == nil {
+		return "", errors.New("unknown master key " + p[0] + ", is " + k.file + " missing?")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(p[1])
+	if err != nil {
+		return "", errors.New("invalid encrypted value")
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("invalid encrypted value")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(p[0]))
+	if err != nil {
+		return "", errors.New("encrypted value can't be decrypted with master key " + p[0])
+	}
+	return string(plain), nil
+}
+
+// isSealed reports if value is encrypted with the current key.
+func (k *keyring) isSealed(value string) bool {
+	return len(k.keys) > 0 && strings.HasPrefix(value, sealedPrefix+k.keys[0].id+":")
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,82 @@
+package user
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestUserSecretsAreEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	d, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Initialize("crypt@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := readRows(s.userConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range userSchema.sensitive {
+		if !strings.HasPrefix(rows[0].fields[i], sealedPrefix) {
+			t.Errorf("field %d is not encrypted: %s", i, rows[0].fields[i])
+		}
+	}
+
+	if err := d.RotateKey(); err != nil {
+		t.Fatal(err)
+	}
+	kr, err := loadKeyring(s.masterKeyFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kr.keys) != 1 {
+		t.Errorf("expected only the new key after rotation, got %d keys", len(kr.keys))
+	}
+	rotated, err := readRows(s.userConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !kr.isSealed(rotated[0].fields[1]) {
+		t.Error("user secret should be encrypted with the new key")
+	}
+	if err := d.Authenticate("crypt@openspock.org", "password", ""); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigrateEncryptsLegacyUsers(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// version 1 stored raw secrets and hashes
+	secret, hash := "se\ncret", "ha\"sh"
+	legacy := "legacy-user,\"" + secret + "\",salt,\"ha\"\"sh\",legacy@openspock.org,legacy user,2002-10-02T10:00:00-05:00,legacy-role\n"
+	if err := ioutil.WriteFile(s.userConf().name, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _ := d.User("legacy@openspock.org")
+	if v.secret != secret || v.hash != hash {
+		t.Errorf("legacy secret and hash not preserved: %q %q", v.secret, v.hash)
+	}
+	data, err := ioutil.ReadFile(s.userConf().name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "salt") {
+		t.Errorf("legacy user should be encrypted after migration:\n%s", data)
+	}
+}
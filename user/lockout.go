@@ -0,0 +1,245 @@
+package user
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/openspock/log"
+)
+
+// errAccountLocked is returned while an account is locked out.
+var errAccountLocked = newError(ErrAccountRefused, "account is locked after too many failed attempts")
+
+// maxSources bounds the number of sources whose failed attempts are kept in
+// memory.
+const maxSources = 10000
+
+// LockoutPolicy throttles and locks out failed authentication attempts. It
+// is configured in the settings of a location:
+//
+//	lockout.threshold   consecutive failed attempts after which an account
+//	                    is locked, 5 by default, 0 never locks accounts
+//	lockout.duration    how long an account stays locked, 15m by default, 0
+//	                    keeps it locked until unlocked by an admin
+//	throttle.delay      wait after the second consecutive failed attempt,
+//	                    1s by default, doubled with every further failure
+//	throttle.max_delay  upper bound of the wait, 1m by default
+//
+// Failed attempts are counted per account and per source, for e.g. the
+// address of a client of the tls server. Attempts made before the wait is
+// over are rejected without checking the password.
+type LockoutPolicy struct {
+	Threshold int
+	Duration  time.Duration
+	Delay     time.Duration
+	MaxDelay  time.Duration
+}
+
+// attempts counts consecutive failed authentication attempts.
+type attempts struct {
+	failures int
+	last     time.Time
+}
+
+func newLockoutPolicy(s Settings) (LockoutPolicy, error) {
+	var p LockoutPolicy
+	var err error
+	if p.Threshold, err = s.Int("lockout.threshold", 5); err != nil {
+		return p, err
+	}
+	if p.Duration, err = s.Duration("lockout.duration", 15*time.Minute); err != nil {
+		return p, err
+	}
+	if p.Delay, err = s.Duration("throttle.delay", time.Second); err != nil {
+		return p, err
+	}
+	if p.MaxDelay, err = s.Duration("throttle.max_delay", time.Minute); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// delay returns how long to wait after a number of consecutive failed
+// attempts. The first failure is not delayed.
+func (p LockoutPolicy) delay(failures int) time.Duration {
+	if failures < 2 {
+		return 0
+	}
+	d := p.Delay
+	for i := 2; i < failures && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// current returns a after an expired lockout has been lifted.
+func (p LockoutPolicy) current(a attempts, now time.Time) attempts {
+	if p.Threshold > 0 && a.failures >= p.Threshold && p.Duration > 0 && !now.Before(a.last.Add(p.Duration)) {
+		return attempts{}
+	}
+	return a
+}
+
+// locked reports if an account with attempts a is locked out.
+func (p LockoutPolicy) locked(a attempts, now time.Time) bool {
+	return p.Threshold > 0 && p.current(a, now).failures >= p.Threshold
+}
+
+// retryAfter returns how long to wait before the next attempt is allowed.
+func (p LockoutPolicy) retryAfter(a attempts, now time.Time) time.Duration {
+	wait := a.last.Add(p.delay(a.failures)).Sub(now)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+func throttled(wait time.Duration) error {
+	return newError(ErrAccountRefused, fmt.Sprintf("too many failed attempts, retry in %s", (wait+time.Second-1).Truncate(time.Second)))
+}
+
+// checkAttempts returns an error if an attempt to authenticate email from
+// source has to be rejected without checking the password.
+func (d *Directory) checkAttempts(source string, u User, now time.Time) error {
+	p := d.snapshot().lockout
+	d.attemptsMu.Lock()
+	defer d.attemptsMu.Unlock()
+	if wait := p.retryAfter(d.sources[source], now); wait > 0 && source != "" {
+		return throttled(wait)
+	}
+	a := p.current(d.accountAttempts(u), now)
+	if p.locked(a, now) {
+		return errAccountLocked
+	}
+	if wait := p.retryAfter(a, now); wait > 0 {
+		return throttled(wait)
+	}
+	return nil
+}
+
+// accountAttempts returns the failed attempts of a user. Read-only locations
+// can't persist them, their attempts are only kept in memory.
+func (d *Directory) accountAttempts(u User) attempts {
+	if d.readOnly() {
+		return d.accounts[u.Email]
+	}
+	return u.attempts
+}
+
+// recordFailure counts a failed attempt for source and, unless it is empty,
+// the account of email. Attempts of accounts are persisted without holding
+// attemptsMu, the store serializes them.
+func (d *Directory) recordFailure(source, email string, now time.Time) {
+	p := d.snapshot().lockout
+	d.attemptsMu.Lock()
+	if source != "" {
+		if len(d.sources) >= maxSources {
+			d.pruneSources(p, now)
+		}
+		d.sources[source] = attempts{d.sources[source].failures + 1, now}
+	}
+	if email != "" && d.readOnly() {
+		a := p.current(d.accounts[email], now)
+		d.accounts[email] = attempts{a.failures + 1, now}
+	}
+	d.attemptsMu.Unlock()
+
+	if email == "" || d.readOnly() {
+		return
+	}
+	d.updateAttempts(email, func(a attempts) attempts {
+		a = p.current(a, now)
+		return attempts{a.failures + 1, now}
+	})
+}
+
+// recordSuccess resets the failed attempts of source and the account of
+// email.
+func (d *Directory) recordSuccess(source, email string) {
+	d.attemptsMu.Lock()
+	delete(d.sources, source)
+	if d.readOnly() {
+		delete(d.accounts, email)
+	}
+	d.attemptsMu.Unlock()
+
+	if d.readOnly() {
+		return
+	}
+	if u, ok := d.User(email); ok && u.attempts.failures > 0 {
+		d.updateAttempts(email, func(attempts) attempts { return attempts{} })
+	}
+}
+
+// updateAttempts persists the failed attempts of a user. Failures are
+// logged, they never fail an authentication.
+func (d *Directory) updateAttempts(email string, update func(attempts) attempts) {
+	err := d.updateUser(email, func(u *User) error {
+		u.attempts = update(u.attempts)
+		return nil
+	})
+	if err != nil {
+		log.Error("Lockout", log.AppMsg, map[string]interface{}{"email": email, "result": "failure", "message": err.Error()})
+	}
+}
+
+// updateUser persists a change to the authentication state of a user. The
+// user is read and written under the store's exclusive lock, so that a
+// concurrent write by another process is neither undone nor missed. Nothing
+// is written if update returns an error.
+func (d *Directory) updateUser(email string, update func(*User) error) error {
+	return d.commitUser(email, func(u *User) ([]Mutation, error) {
+		return nil, update(u)
+	})
+}
+
+// commitUser is updateUser for changes which commit further mutations along
+// with the user, for e.g. revoking their sessions.
+func (d *Directory) commitUser(email string, update func(*User) ([]Mutation, error)) error {
+	if err := d.config.UpdateUser(email, update); err != nil {
+		return err
+	}
+	return d.Reload()
+}
+
+// pruneSources forgets sources which may attempt again without waiting.
+func (d *Directory) pruneSources(p LockoutPolicy, now time.Time) {
+	for source, a := range d.sources {
+		if p.retryAfter(a, now) == 0 {
+			delete(d.sources, source)
+		}
+	}
+}
+
+// readOnly reports if the location can't be written to.
+func (d *Directory) readOnly() bool {
+	return d.config.FileAccessProtocol == HTTP
+}
+
+// UnlockUser lifts the lockout of a user and resets their failed attempts.
+func (d *Directory) UnlockUser(email string) error {
+	log.Info("UnlockUser", log.AppMsg, map[string]interface{}{"email": email})
+
+	if d.readOnly() {
+		if _, ok := d.User(email); !ok {
+			return newError(ErrNotFound, email+" does not exist")
+		}
+		d.attemptsMu.Lock()
+		delete(d.accounts, email)
+		d.attemptsMu.Unlock()
+	} else {
+		err := d.updateUser(email, func(u *User) error {
+			u.attempts = attempts{}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Info("UnlockUser", log.AppMsg, map[string]interface{}{"email": email, "result": "success", "message": email + " has been unlocked"})
+	return nil
+}
@@ -0,0 +1,138 @@
+package user
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openWithSettings(t *testing.T, settings string) (*Directory, string) {
+	useFastHasher(t)
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "userd.conf"), []byte(settings), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, dir
+}
+
+func TestLockout(t *testing.T) {
+	d, dir := openWithSettings(t, "lockout.threshold,3\nlockout.duration,500ms\nthrottle.delay,0s\n")
+	if err := d.Initialize("lockout@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := d.Authenticate("lockout@openspock.org", "wrong", ""); err == nil || err == errAccountLocked {
+			t.Fatalf("attempt %d: expected a password mismatch, got %v", i, err)
+		}
+	}
+	if err := d.Authenticate("lockout@openspock.org", "password", ""); err != errAccountLocked {
+		t.Fatalf("expected the account to be locked, got %v", err)
+	}
+
+	// the lockout survives a restart
+	reopened, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Authenticate("lockout@openspock.org", "password", ""); err != errAccountLocked {
+		t.Fatalf("expected the account to stay locked, got %v", err)
+	}
+	// a change made meanwhile by another process survives the unlock
+	if err := d.AddUserToGroup("lockout@openspock.org", "ops"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.UnlockUser("lockout@openspock.org"); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := reopened.User("lockout@openspock.org"); len(u.Groups) != 1 {
+		t.Errorf("unlocking should not undo concurrent changes, got groups %v", u.Groups)
+	}
+	if err := reopened.Authenticate("lockout@openspock.org", "password", ""); err != nil {
+		t.Fatalf("unlocked account should authenticate: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		reopened.Authenticate("lockout@openspock.org", "wrong", "")
+	}
+	if err := reopened.Authenticate("lockout@openspock.org", "password", ""); err != errAccountLocked {
+		t.Fatalf("expected the account to be locked, got %v", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if err := reopened.Authenticate("lockout@openspock.org", "password", ""); err != nil {
+		t.Errorf("lockout should expire: %v", err)
+	}
+	if u, _ := reopened.User("lockout@openspock.org"); u.attempts.failures != 0 {
+		t.Errorf("successful login should reset failed attempts, got %d", u.attempts.failures)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	d, _ := openWithSettings(t, "lockout.threshold,0\nthrottle.delay,1h\n")
+	if err := d.Initialize("throttle@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	// per source
+	for i := 0; i < 2; i++ {
+		d.AuthenticateFrom("10.0.0.1", "nobody@openspock.org", "wrong", "")
+	}
+	if err := d.AuthenticateFrom("10.0.0.1", "throttle@openspock.org", "password", ""); err == nil || !strings.HasPrefix(err.Error(), "too many failed attempts") {
+		t.Errorf("expected source to be throttled, got %v", err)
+	}
+	if err := d.AuthenticateFrom("10.0.0.2", "throttle@openspock.org", "password", ""); err != nil {
+		t.Errorf("other sources should not be throttled: %v", err)
+	}
+
+	// per account
+	d.AuthenticateFrom("10.0.0.3", "throttle@openspock.org", "wrong", "")
+	d.AuthenticateFrom("10.0.0.4", "throttle@openspock.org", "wrong", "")
+	if err := d.AuthenticateFrom("10.0.0.5", "throttle@openspock.org", "password", ""); err == nil || !strings.HasPrefix(err.Error(), "too many failed attempts") {
+		t.Errorf("expected account to be throttled, got %v", err)
+	}
+}
+
+func TestLockoutDelay(t *testing.T) {
+	p := LockoutPolicy{Delay: time.Second, MaxDelay: 5 * time.Second}
+	for failures, expected := range map[int]time.Duration{0: 0, 1: 0, 2: time.Second, 3: 2 * time.Second, 4: 4 * time.Second, 5: 5 * time.Second, 100: 5 * time.Second} {
+		if d := p.delay(failures); d != expected {
+			t.Errorf("delay(%d) = %s, expected %s", failures, d, expected)
+		}
+	}
+}
+
+func TestConcurrentFailuresAreCounted(t *testing.T) {
+	d, dir := openWithSettings(t, "lockout.threshold,100\nthrottle.delay,0s\n")
+	if err := d.Initialize("lockout@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	// two directories stand in for two processes sharing the location
+	other, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for _, d := range []*Directory{d, other} {
+		wg.Add(1)
+		go func(d *Directory) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				d.recordFailure("", "lockout@openspock.org", time.Now())
+			}
+		}(d)
+	}
+	wg.Wait()
+
+	if err := d.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := d.User("lockout@openspock.org"); u.attempts.failures != 20 {
+		t.Errorf("expected every failed attempt to be counted, got %d", u.attempts.failures)
+	}
+}
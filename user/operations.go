@@ -1,12 +1,13 @@
 package user
 
 import (
-	"crypto/rand"
-	"encoding/base64"
 	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
-	"github.com/openspock/crypto/hashes"
 	"github.com/openspock/log"
 )
 
@@ -26,116 +27,177 @@ func (t RoleType) String() string {
 	return [...]string{"<nil>", "admin"}[t]
 }
 
-// CreateUser creates a new user.
-func CreateUser(email, password, description, roleID, file, adminUsr, adminPwd string) error {
+// CreateUser creates a new user. Passwords which break the password policy
+// of the location are rejected with a *PasswordPolicyError.
+func (d *Directory) CreateUser(email, password, description, roleID string) error {
 	log.Info("CreateUser", log.AppMsg, map[string]interface{}{"email": email, "description": description})
 
-	if adminUsr != "init" {
-		Authenticate(adminUsr, adminPwd, file)
-	}
-
-	c, err := NewConfig(file)
+	u, err := d.snapshot().newUserWithPassword(email, password, description, roleID)
 	if err != nil {
 		return err
 	}
-	secret := make([]byte, 8)
-	_, err = rand.Read(secret)
-	if err != nil {
+	if err := d.config.WriteUser(u); err != nil {
 		return err
 	}
-	salt := make([]byte, 8)
-	_, err = rand.Read(salt)
-	if err != nil {
+	if err := d.Reload(); err != nil {
 		return err
 	}
-	saltStr := base64.StdEncoding.EncodeToString(salt)
-	hash, err := hashes.CalculateHmacSha256([]byte(password+saltStr), secret)
+	log.Info("CreateUser", log.AppMsg, map[string]interface{}{"email": email, "result": "success", "message": email + " has been created successfully"})
+	return nil
+}
+
+// Initialize sets up userd at a location by creating the admin role along with
+// its first user. Both are committed together, an interrupted initialization
+// never leaves behind an admin role without an admin.
+func (d *Directory) Initialize(email, password string) error {
+	log.Info("Initialize", log.AppMsg, map[string]interface{}{"email": email, "location": d.config.Location})
+
+	r, err := d.NewRole(Admin.String())
 	if err != nil {
 		return err
 	}
-	u, err := NewUser(email, description, string(secret), saltStr, string(hash), roleID)
+	// the admin role is only committed along with the user
+	u, err := d.snapshot().withRole(*r).newUserWithPassword(email, password, "Userd admin", r.RoleID)
 	if err != nil {
 		return err
 	}
-	if err := c.WriteUser(u); err != nil {
+	if err := d.config.Apply(Mutation{Role: r}, Mutation{User: u}); err != nil {
 		return err
 	}
-	log.Info("CreateUser", log.AppMsg, map[string]interface{}{"email": email, "result": "success", "message": email + " has been created successfully"})
+	if err := d.Reload(); err != nil {
+		return err
+	}
+
+	log.Info("Initialize", log.AppMsg, map[string]interface{}{"email": email, "location": d.config.Location, "result": "success", "message": "userd has been initialized"})
 	return nil
 }
 
-// ChangePassword changes the password for a user.
-func ChangePassword(email, password, newPassword, confirmPassword, file string) error {
+func (t *tables) newUserWithPassword(email, password, description, roleID string) (*User, error) {
+	if err := t.policy.check(password, nil); err != nil {
+		return nil, err
+	}
+	hash, err := Hasher.Hash(password)
+	if err != nil {
+		return nil, err
+	}
+	return t.newUser(email, description, "", "", hash, roleID)
+}
+
+// ChangePassword changes the password for a user and revokes their sessions.
+// Passwords which break the password policy of the location are rejected
+// with a *PasswordPolicyError.
+func (d *Directory) ChangePassword(email, password, totp, newPassword, confirmPassword string) error {
+	return d.ChangePasswordFrom("", email, password, totp, newPassword, confirmPassword)
+}
+
+// ChangePasswordFrom changes the password for a user with credentials sent
+// from source, see AuthenticateFrom.
+func (d *Directory) ChangePasswordFrom(source, email, password, totp, newPassword, confirmPassword string) error {
 	log.Info("ChangePassword", log.AppMsg, map[string]interface{}{"email": email})
 
 	if newPassword != confirmPassword {
-		return errors.New("new and confirm password not the same")
+		return newError(ErrInvalid, "new and confirm password not the same")
 	}
 
-	c, err := NewConfig(file)
-	if err != nil {
+	if err := d.AuthenticateFrom(source, email, password, totp); err != nil {
 		return err
 	}
 
-	if err := Authenticate(email, password, file); err != nil {
+	t := d.snapshot()
+	err := d.commitUser(email, func(u *User) ([]Mutation, error) {
+		if err := t.setNewPassword(u, newPassword); err != nil {
+			return nil, err
+		}
+		return t.sessionsOf(email), nil
+	})
+	if err != nil {
 		return err
 	}
 
-	u := UserTable[email]
+	log.Info("ChangePassword", log.AppMsg, map[string]interface{}{"email": email, "result": "success", "message": "password changed successfully for " + email})
 
-	hash, err := hashes.CalculateHmacSha256([]byte(newPassword+u.Salt), []byte(u.secret))
-	if err != nil {
+	return nil
+}
+
+// setNewPassword replaces the password of u following the password policy.
+func (t *tables) setNewPassword(u *User, password string) error {
+	if err := t.policy.check(password, u); err != nil {
 		return err
 	}
-	u.hash = string(hash)
+	keep := t.policy.History - 1
+	if keep < 0 {
+		keep = 0
+	}
+	return u.changePassword(password, keep)
+}
 
-	if err := c.WriteUser(&u); err != nil {
-		return err
+// DeleteUser deletes a user along with all file permissions granted to them,
+// their sessions, their certificate mappings and, for service accounts, their
+// API keys.
+func (d *Directory) DeleteUser(email string) error {
+	log.Info("DeleteUser", log.AppMsg, map[string]interface{}{"email": email})
+
+	t := d.snapshot()
+	u, ok := t.users[email]
+	if !ok {
+		return newError(ErrNotFound, email+" does not exist")
 	}
 
-	log.Info("ChangePassword", log.AppMsg, map[string]interface{}{"email": email, "result": "success", "message": "password changed successfully for " + email})
+	mutations := append(t.sessionsOf(email), t.apiKeysOf(email)...)
+	mutations = append(mutations, t.certMappingsOf(email)...)
+	for _, fps := range t.fps[u.UserID] {
+		for i := range fps {
+			mutations = append(mutations, Mutation{FP: &fps[i], Delete: true})
+		}
+	}
+	if err := d.config.Apply(append(mutations, Mutation{User: &u, Delete: true})...); err != nil {
+		return err
+	}
+	if err := d.Reload(); err != nil {
+		return err
+	}
 
+	log.Info("DeleteUser", log.AppMsg, map[string]interface{}{"email": email, "result": "success", "message": email + " has been deleted"})
 	return nil
 }
 
-// ExpireUser sets the expiration date of the user to now.
-func ExpireUser(email string) {
-	log.Info("ExpireUser", log.AppMsg, map[string]interface{}{"email": email})
-}
-
-// CreateRole creates a new role.
-func CreateRole(name, file string) (*Role, error) {
-	log.Info("CreateRole", log.AppMsg, map[string]interface{}{"role_name": name})
-	c, err := NewConfig(file)
+// CreateRole creates a new role which inherits from the roles with the
+// RoleIDs in parents.
+func (d *Directory) CreateRole(name string, parents ...string) (*Role, error) {
+	log.Info("CreateRole", log.AppMsg, map[string]interface{}{"role_name": name, "parents": strings.Join(parents, ",")})
+	r, err := d.NewRole(name)
 	if err != nil {
 		return nil, err
 	}
-	r, err := NewRole(name)
-	if err != nil {
+	if err := d.snapshot().checkParents(r.RoleID, parents); err != nil {
 		return nil, err
 	}
-	if err := c.WriteRole(r); err != nil {
+	r.Parents = parents
+	if err := d.config.WriteRole(r); err != nil {
+		return nil, err
+	}
+	if err := d.Reload(); err != nil {
 		return nil, err
 	}
 	log.Info("CreateRole", log.AppMsg, map[string]interface{}{"role_name": name, "result": "success", "message": name + " has been created"})
 	return r, nil
 }
 
-// CreateFP creates a new file permission for either a user or a role.
-func CreateFP(file string, user *User, role *Role, expiration time.Time, location string) (*FilePermission, error) {
-	log.Info("CreateFP", log.AppMsg, map[string]interface{}{"file": file})
+// CreateFP creates a new file permission for either a user or a role which
+// grants actions on a resource. It replaces the actions of an existing file
+// permission for the same user or role.
+func (d *Directory) CreateFP(file string, user *User, role *Role, actions []string, expiration time.Time) (*FilePermission, error) {
+	log.Info("CreateFP", log.AppMsg, map[string]interface{}{"file": file, "actions": strings.Join(actions, ",")})
 
-	c, err := NewConfig(location)
+	fp, err := NewFP(file, *user, *role, actions, expiration)
 	if err != nil {
 		return nil, err
 	}
 
-	fp, err := NewFP(file, *user, *role, expiration)
-	if err != nil {
+	if err := d.config.WriteFP(fp); err != nil {
 		return nil, err
 	}
-
-	if err := c.WriteFP(fp); err != nil {
+	if err := d.Reload(); err != nil {
 		return nil, err
 	}
 
@@ -144,25 +206,123 @@ func CreateFP(file string, user *User, role *Role, expiration time.Time, locatio
 	return fp, nil
 }
 
-// Authenticate authenticates a user's credentials for access to the system.
-func Authenticate(email, password, file string) error {
-	log.Info("Authenticate", log.AppMsg, map[string]interface{}{"email": email})
+// RevokeFP revokes the file permission for a resource granted to either a
+// user or a role.
+func (d *Directory) RevokeFP(file string, user *User, role *Role) error {
+	log.Info("RevokeFP", log.AppMsg, map[string]interface{}{"file": file})
 
-	if _, err := NewConfig(file); err != nil {
+	var mutations []Mutation
+	fps := d.snapshot().fps[user.UserID][file]
+	for i := range fps {
+		if fps[i].Role.RoleID == role.RoleID {
+			mutations = append(mutations, Mutation{FP: &fps[i], Delete: true})
+		}
+	}
+	if len(mutations) == 0 {
+		return newError(ErrNotFound, file+" permission does not exist")
+	}
+	if err := d.config.Apply(mutations...); err != nil {
+		return err
+	}
+	if err := d.Reload(); err != nil {
 		return err
 	}
 
-	v, ok := UserTable[email]
+	log.Info("RevokeFP", log.AppMsg, map[string]interface{}{"file": file, "result": "success", "message": "Permission for " + file + " has been revoked"})
+
+	return nil
+}
+
+// Compact rewrites the data files of a location down to their current state,
+// discarding superseded and deleted records.
+func (d *Directory) Compact() error {
+	file := d.config.Location
+	log.Info("Compact", log.AppMsg, map[string]interface{}{"location": file})
+
+	if err := d.config.Store.Compact(); err != nil {
+		return err
+	}
+
+	log.Info("Compact", log.AppMsg, map[string]interface{}{"location": file, "result": "success", "message": file + " has been compacted"})
+
+	return nil
+}
+
+// RotateKey replaces the master key of a location and re-encrypts all
+// records with the new key.
+func (d *Directory) RotateKey() error {
+	file := d.config.Location
+	log.Info("RotateKey", log.AppMsg, map[string]interface{}{"location": file})
+
+	kr, ok := d.config.Store.(KeyRotator)
+	if !ok {
+		return newError(ErrInvalid, file+" does not encrypt records")
+	}
+	if err := kr.RotateKey(); err != nil {
+		return err
+	}
+
+	log.Info("RotateKey", log.AppMsg, map[string]interface{}{"location": file, "result": "success", "message": "master key of " + file + " has been rotated"})
+
+	return nil
+}
+
+// Authenticate authenticates a user's credentials for access to the system.
+// Users who enrolled a TOTP secret, or who are required to by their role,
+// also have to send a TOTP or recovery code, otherwise totp is ignored.
+func (d *Directory) Authenticate(email, password, totp string) error {
+	return d.AuthenticateFrom("", email, password, totp)
+}
+
+// AuthenticateFrom authenticates a user's credentials sent from source, for
+// e.g. the address of a client. Failed attempts are throttled and lock out
+// the account following the lockout policy of the location.
+func (d *Directory) AuthenticateFrom(source, email, password, totp string) error {
+	return d.authenticate(source, email, password, totp, false)
+}
+
+// authenticate authenticates a user's credentials. While enrolling, users who
+// are required to use a second factor but have none yet authenticate with
+// their password alone.
+func (d *Directory) authenticate(source, email, password, totp string, enrolling bool) error {
+	log.Info("Authenticate", log.AppMsg, map[string]interface{}{"email": email, "source": source})
+
+	now := time.Now()
+	v, ok := d.User(email)
+	if err := d.checkAttempts(source, v, now); err != nil {
+		return err
+	}
 	if !ok {
-		return errors.New(email + " does not exist")
+		d.recordFailure(source, "", now)
+		return newError(ErrNotFound, email+" does not exist")
+	}
+	if v.Service {
+		d.recordFailure(source, "", now)
+		return newError(ErrBadCredentials, email+" is a service account, it authenticates with api keys")
 	}
 
-	h, err := hashes.CalculateHmacSha256([]byte(password+v.Salt), []byte(v.secret))
+	match, err := verifyPassword(v, password)
 	if err != nil {
 		return err
 	}
-	if string(h) != v.hash {
-		return errors.New("password does not match")
+	if !match {
+		d.recordFailure(source, email, now)
+		return newError(ErrBadCredentials, "password does not match")
+	}
+	if err := v.checkStatus(now); err != nil {
+		return err
+	}
+	if d.snapshot().requiresTOTP(v) && (v.totp.enrolled() || !enrolling) {
+		if err := d.checkSecondFactor(v, totp, now); err != nil {
+			if err != errSecondFactorRequired {
+				d.recordFailure(source, email, now)
+			}
+			return err
+		}
+	}
+	d.recordSuccess(source, email)
+	if v.needsRehash() {
+		d.rehash(v, password)
 	}
 
 	log.Info("Authenticate", log.AppMsg, map[string]interface{}{"email": email, "result": "success", "message": "user successfully authenticated"})
@@ -170,77 +330,210 @@ func Authenticate(email, password, file string) error {
 	return nil
 }
 
+// rehash upgrades the password hash of a user who just authenticated to the
+// current Hasher. A failed upgrade doesn't fail the login, the user keeps the
+// old hash until the next one.
+func (d *Directory) rehash(u User, password string) {
+	if d.readOnly() {
+		// the hash is upgraded by logins against the source
+		return
+	}
+	// another process may have changed the password meanwhile, only replace
+	// the hash that was verified
+	changed := errors.New("password changed meanwhile")
+	err := d.updateUser(u.Email, func(current *User) error {
+		if current.hash != u.hash {
+			return changed
+		}
+		return current.setPassword(password)
+	})
+	if err == changed || errors.Is(err, ErrNotFound) {
+		return
+	}
+	if err != nil {
+		log.Error("Rehash", log.AppMsg, map[string]interface{}{"email": u.Email, "result": "failure", "message": err.Error()})
+		return
+	}
+	log.Info("Rehash", log.AppMsg, map[string]interface{}{"email": u.Email, "result": "success", "message": "password hash upgraded for " + u.Email})
+}
+
 // AuthenticateForRole authenticates a user's credentials and then validates
 // if the user is of a required role for that operation.
-func AuthenticateForRole(email, password, file string, roleType RoleType) error {
-	if err := Authenticate(email, password, file); err != nil {
+func (d *Directory) AuthenticateForRole(email, password, totp string, roleType RoleType) error {
+	if err := d.Authenticate(email, password, totp); err != nil {
 		return err
 	}
-	if roleType.String() != RoleTable[UserTable[email].RoleID].Name {
-		return errors.New("role does not match " + roleType.String())
+	t := d.snapshot()
+	for roleID := range t.effectiveRoles(t.users[email]) {
+		if roleType.String() == t.roles[roleID].Name {
+			return nil
+		}
 	}
+	return newError(ErrRoleMismatch, "role does not match "+roleType.String())
+}
 
-	return nil
+// Authorize authorizes an action, for e.g. read or write, on a resource.
+func (d *Directory) Authorize(email, password, totp, resource, action string) error {
+	return d.AuthorizeFrom("", email, password, totp, resource, action)
 }
 
-// Authorize authorizes acccess to a resource.
-func Authorize(email, password, file, resource string) error {
+// AuthorizeFrom authorizes an action on a resource with credentials sent from
+// source, see AuthenticateFrom.
+func (d *Directory) AuthorizeFrom(source, email, password, totp, resource, action string) error {
 	log.Info("Authorize", log.AppMsg, map[string]interface{}{"email": email})
 
-	if err := Authenticate(email, password, file); err != nil {
+	if err := d.AuthenticateFrom(source, email, password, totp); err != nil {
 		return err
 	}
+	return d.authorize(email, resource, action)
+}
 
-	u := UserTable[email]
-	var fps []FilePermission
-	var ok bool
-	fps, ok = FilePermissionTable[u.UserID][resource]
-
-	if !ok {
-		// check for role specific perms
-		fps, ok = FilePermissionTable[""][resource]
-		if !ok {
-			return errors.New(resource + " permission does not exist for " + email)
-		}
+// authorize authorizes an action on a resource for an authenticated user.
+// Each file permission whose resource pattern matches is evaluated on its
+// own, see explain. File permissions of a role apply to users holding the
+// role or a role inheriting from it.
+func (d *Directory) authorize(email, resource, action string) error {
+	e, err := d.snapshot().explain(email, resource, action)
+	if err != nil {
+		return err
 	}
-	var isRoleOk bool = false
-	var isExpirationOk bool = false
-	for _, fp := range fps {
-		if !isRoleOk && (fp.Role.RoleID == "" || fp.Role.RoleID == u.RoleID) {
-			isRoleOk = true
-		}
-		if time.Now().Before(fp.Expiration) {
-			isExpirationOk = true
-		}
+
+	log.Info("Authorize", log.AppMsg, map[string]interface{}{"email": email, "result": "success", "message": "user successfully authorized", "resource": resource, "action": action, "pattern": e.Pattern})
+
+	return nil
+}
+
+// MigrateTo copies all roles, users, file permissions, sessions, API keys and
+// certificate mappings along with the settings to another location, for e.g.
+// from file:///etc/userd to mem://userd. The target location may use a
+// different storage backend than the source.
+func (d *Directory) MigrateTo(to string) error {
+	from := d.config.Location
+	log.Info("MigrateTo", log.AppMsg, map[string]interface{}{"from": from, "to": to})
+
+	src := d.config
+	dst, err := NewConfig(to)
+	if err != nil {
+		return err
 	}
 
-	if !isRoleOk {
-		return errors.New("user does not have required role")
+	settings, mutations, err := readMigration(src)
+	if err != nil {
+		return err
 	}
-	if !isExpirationOk {
-		return errors.New("file permission expired")
+	if err := migrateSettings(src, dst, settings); err != nil {
+		return err
+	}
+	if err := dst.Apply(mutations...); err != nil {
+		return err
 	}
 
-	log.Info("Authorize", log.AppMsg, map[string]interface{}{"email": email, "result": "success", "message": "user successfully authorized", "resource": resource})
+	log.Info("MigrateTo", log.AppMsg, map[string]interface{}{"from": from, "to": to, "result": "success", "message": "migrated " + from + " to " + to})
 
 	return nil
 }
 
+// readMigration reads the settings and all records of src under its read
+// lock, so that they are copied as of a single point in time. The lock is
+// released before anything is written, the target might share it with src.
+func readMigration(src *Configuration) (Settings, []Mutation, error) {
+	unlock, err := src.Store.RLock()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	settings, err := src.Store.ReadSettings()
+	if err != nil {
+		return nil, nil, storageError(err)
+	}
+	var mutations []Mutation
+	roles, err := src.Store.ReadRoles()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range roles {
+		mutations = append(mutations, Mutation{Role: &roles[i]})
+	}
+	users, err := src.Store.ReadUsers()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range users {
+		mutations = append(mutations, Mutation{User: &users[i]})
+	}
+	fps, err := src.Store.ReadFPs()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range fps {
+		mutations = append(mutations, Mutation{FP: &fps[i]})
+	}
+	sessions, err := src.Store.ReadSessions()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range sessions {
+		mutations = append(mutations, Mutation{Session: &sessions[i]})
+	}
+	keys, err := src.Store.ReadAPIKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range keys {
+		mutations = append(mutations, Mutation{APIKey: &keys[i]})
+	}
+	mappings, err := src.Store.ReadCertMappings()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range mappings {
+		mutations = append(mutations, Mutation{CertMapping: &mappings[i]})
+	}
+	return settings, mutations, nil
+}
+
+// migrateSettings writes the settings of src to dst. A banned passwords file
+// relative to a file location is copied along to a file location, other
+// locations refer to it by its absolute path.
+func migrateSettings(src, dst *Configuration, settings Settings) error {
+	if file := settings["password.banned_file"]; file != "" && !filepath.IsAbs(file) && src.FileAccessProtocol == File {
+		if dst.FileAccessProtocol != File {
+			settings["password.banned_file"] = filepath.Join(src.Location, file)
+		} else if err := copyFile(filepath.Join(src.Location, file), filepath.Join(dst.Location, file)); err != nil {
+			return storageError(err)
+		}
+	}
+	return dst.WriteSettings(settings)
+}
+
+// copyFile copies the contents of the file from to the file to.
+func copyFile(from, to string) error {
+	b, err := ioutil.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(to, b, 0644)
+}
+
 // GetRoleIDFor returns the RoleID for a RoleName
-func GetRoleIDFor(name string) (string, error) {
-	for _, v := range RoleTable {
+func (d *Directory) GetRoleIDFor(name string) (string, error) {
+	for _, v := range d.snapshot().roles {
 		if v.Name == name {
 			return v.RoleID, nil
 		}
 	}
-	return "", errors.New("Role not found for name " + name)
+	return "", newError(ErrNotFound, "Role not found for name "+name)
 }
 
 // ListRoles lists all available roles.
-func ListRoles() map[string]interface{} {
+func (d *Directory) ListRoles() map[string]interface{} {
 	m := make(map[string]interface{})
 
-	for k, v := range RoleTable {
+	for k, v := range d.snapshot().roles {
 		m[k] = v
 	}
 
@@ -3,7 +3,11 @@ package user
 import "testing"
 
 func TestCreateUser(t *testing.T) {
-	err := CreateUser("testing@email.org", "whyilovewritingunittests", "a test description", "1", "file://./config/sample", "", "")
+	d, err := Open("file://./config/sample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.CreateUser("testing@email.org", "whyilovewritingunittests", "a test description", "1")
 	if err != nil {
 		t.Error(err)
 		t.Fail()
@@ -11,7 +15,11 @@ func TestCreateUser(t *testing.T) {
 }
 
 func TestAuthenticateUser(t *testing.T) {
-	err := Authenticate("testing@email.org", "whyilovewritingunittests", "file://./config/sample")
+	d, err := Open("file://./config/sample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Authenticate("testing@email.org", "whyilovewritingunittests", "")
 	if err != nil {
 		t.Error(err)
 		t.Fail()
@@ -19,14 +27,22 @@ func TestAuthenticateUser(t *testing.T) {
 }
 
 func TestCreateRoleShouldFailForExistingRole(t *testing.T) {
-	if _, err := CreateRole("admin", "file://./config/sample"); err == nil {
+	d, err := Open("file://./config/sample")
+	if err == nil {
+		_, err = d.CreateRole("admin")
+	}
+	if err == nil {
 		t.Errorf("CreateRole should fail for an existing role")
 		t.FailNow()
 	}
 }
 
 func TestCreateRoleForNonExistingRole(t *testing.T) {
-	if _, err := CreateRole("api", "file://./config/sample"); err != nil {
+	d, err := Open("file://./config/sample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CreateRole("api"); err != nil {
 		t.Errorf("CreateRole should fail for an existing role")
 		t.FailNow()
 	}
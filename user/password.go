@@ -0,0 +1,311 @@
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/openspock/crypto/hashes"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PasswordHasher hashes passwords into encoded hashes which carry the
+// algorithm and parameters they were made with, for e.g.
+//
+//	$argon2id$v=19$m=65536,t=3,p=4$<base64 salt>$<base64 key>
+//
+// so that any hasher can verify hashes of its algorithm regardless of the
+// parameters it is configured with.
+type PasswordHasher interface {
+	// Hash returns the encoded hash of password.
+	Hash(password string) (string, error)
+	// Verify reports if password matches an encoded hash of this algorithm.
+	Verify(password, encoded string) (bool, error)
+	// NeedsRehash reports if an encoded hash was made with another algorithm
+	// or other parameters than the hasher's.
+	NeedsRehash(encoded string) bool
+}
+
+// Hasher hashes all new and changed passwords. Hashes made by another
+// algorithm or with other parameters are upgraded on the next successful
+// login.
+var Hasher PasswordHasher = DefaultArgon2idHasher
+
+// DefaultArgon2idHasher follows the recommended argon2id parameters of
+// RFC 9106 for memory constrained environments.
+var DefaultArgon2idHasher = Argon2idHasher{Time: 3, Memory: 64 * 1024, Threads: 4, SaltLength: 16, KeyLength: 32}
+
+// NewHasher returns the default hasher of an algorithm, one of argon2id,
+// bcrypt or scrypt.
+func NewHasher(algorithm string) (PasswordHasher, error) {
+	switch algorithm {
+	case "argon2id":
+		return DefaultArgon2idHasher, nil
+	case "bcrypt":
+		return BcryptHasher{Cost: bcrypt.DefaultCost}, nil
+	case "scrypt":
+		return ScryptHasher{LogN: 15, R: 8, P: 1, SaltLength: 16, KeyLength: 32}, nil
+	default:
+		return nil, errors.New("unknown password hashing algorithm " + algorithm)
+	}
+}
+
+// hasherOf returns a hasher which can verify an encoded hash.
+func hasherOf(encoded string) (PasswordHasher, error) {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return Argon2idHasher{}, nil
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		return BcryptHasher{}, nil
+	case strings.HasPrefix(encoded, "$scrypt$"):
+		return ScryptHasher{}, nil
+	default:
+		return nil, errors.New("unknown password hash")
+	}
+}
+
+// Argon2idHasher hashes passwords with argon2id. Memory is in KiB.
+type Argon2idHasher struct {
+	Time       uint32
+	Memory     uint32
+	Threads    uint8
+	SaltLength uint32
+	KeyLength  uint32
+}
+
+// Hash implements PasswordHasher.
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt, err := randomBytes(h.SaltLength)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.Memory, h.Time, h.Threads, encodeSegment(salt), encodeSegment(key)), nil
+}
+
+// Verify implements PasswordHasher.
+func (h Argon2idHasher) Verify(password, encoded string) (bool, error) {
+	p, salt, key, err := parseArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// NeedsRehash implements PasswordHasher.
+func (h Argon2idHasher) NeedsRehash(encoded string) bool {
+	p, salt, key, err := parseArgon2id(encoded)
+	return err != nil || p.Time != h.Time || p.Memory != h.Memory || p.Threads != h.Threads ||
+		uint32(len(salt)) != h.SaltLength || uint32(len(key)) != h.KeyLength
+}
+
+func parseArgon2id(encoded string) (p Argon2idHasher, salt, key []byte, err error) {
+	var version int
+	s := strings.Split(encoded, "$")
+	if len(s) != 6 || s[1] != "argon2id" {
+		return p, nil, nil, errors.New("invalid argon2id hash")
+	}
+	if _, err := fmt.Sscanf(s[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, errors.New("unsupported argon2id version")
+	}
+	if _, err := fmt.Sscanf(s[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, nil, errors.New("invalid argon2id parameters")
+	}
+	if salt, err = decodeSegment(s[4]); err != nil {
+		return p, nil, nil, errors.New("invalid argon2id salt")
+	}
+	if key, err = decodeSegment(s[5]); err != nil || len(key) == 0 {
+		return p, nil, nil, errors.New("invalid argon2id key")
+	}
+	return p, salt, key, nil
+}
+
+// BcryptHasher hashes passwords with bcrypt. Note that bcrypt only uses the
+// first 72 bytes of a password.
+type BcryptHasher struct {
+	Cost int
+}
+
+// Hash implements PasswordHasher.
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	return string(hash), err
+}
+
+// Verify implements PasswordHasher.
+func (h BcryptHasher) Verify(password, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// NeedsRehash implements PasswordHasher.
+func (h BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+// ScryptHasher hashes passwords with scrypt, N is 2^LogN.
+type ScryptHasher struct {
+	LogN       int
+	R          int
+	P          int
+	SaltLength uint32
+	KeyLength  uint32
+}
+
+// Hash implements PasswordHasher.
+func (h ScryptHasher) Hash(password string) (string, error) {
+	salt, err := randomBytes(h.SaltLength)
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(password), salt, 1<<uint(h.LogN), h.R, h.P, int(h.KeyLength))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", h.LogN, h.R, h.P, encodeSegment(salt), encodeSegment(key)), nil
+}
+
+// Verify implements PasswordHasher.
+func (h ScryptHasher) Verify(password, encoded string) (bool, error) {
+	p, salt, key, err := parseScrypt(encoded)
+	if err != nil {
+		return false, err
+	}
+	other, err := scrypt.Key([]byte(password), salt, 1<<uint(p.LogN), p.R, p.P, len(key))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// NeedsRehash implements PasswordHasher.
+func (h ScryptHasher) NeedsRehash(encoded string) bool {
+	p, salt, key, err := parseScrypt(encoded)
+	return err != nil || p.LogN != h.LogN || p.R != h.R || p.P != h.P ||
+		uint32(len(salt)) != h.SaltLength || uint32(len(key)) != h.KeyLength
+}
+
+func parseScrypt(encoded string) (p ScryptHasher, salt, key []byte, err error) {
+	s := strings.Split(encoded, "$")
+	if len(s) != 5 || s[1] != "scrypt" {
+		return p, nil, nil, errors.New("invalid scrypt hash")
+	}
+	if _, err := fmt.Sscanf(s[2], "ln=%d,r=%d,p=%d", &p.LogN, &p.R, &p.P); err != nil || p.LogN < 1 || p.LogN > 30 {
+		return p, nil, nil, errors.New("invalid scrypt parameters")
+	}
+	if salt, err = decodeSegment(s[3]); err != nil {
+		return p, nil, nil, errors.New("invalid scrypt salt")
+	}
+	if key, err = decodeSegment(s[4]); err != nil || len(key) == 0 {
+		return p, nil, nil, errors.New("invalid scrypt key")
+	}
+	return p, salt, key, nil
+}
+
+// verifyPassword checks password against the hash of a user. Users created
+// before pluggable hashers have a per user secret and an HMAC-SHA256 hash of
+// the salted password.
+func verifyPassword(u User, password string) (bool, error) {
+	if u.isLegacy() {
+		h, err := hashes.CalculateHmacSha256([]byte(password+u.Salt), []byte(u.secret))
+		if err != nil {
+			return false, err
+		}
+		return hmac.Equal(h, []byte(u.hash)), nil
+	}
+	h, err := hasherOf(u.hash)
+	if err != nil {
+		return false, err
+	}
+	return h.Verify(password, u.hash)
+}
+
+// setPassword replaces the hash of a user with a hash of password made by
+// Hasher.
+func (u *User) setPassword(password string) error {
+	hash, err := Hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	u.secret, u.Salt, u.hash = "", "", hash
+	return nil
+}
+
+// changePassword replaces the password of a user. The hash of the replaced
+// password is added to the history, which keeps the keep most recent hashes.
+func (u *User) changePassword(password string, keep int) error {
+	history := u.history
+	if !u.isLegacy() {
+		history = append([]string{u.hash}, history...)
+	}
+	if len(history) > keep {
+		history = history[:keep]
+	}
+	if err := u.setPassword(password); err != nil {
+		return err
+	}
+	u.history = history
+	return nil
+}
+
+// usedPassword reports if password is one of the n most recent passwords of
+// a user, including the current one.
+func (u User) usedPassword(password string, n int) (bool, error) {
+	if n == 0 {
+		return false, nil
+	}
+	if match, err := verifyPassword(u, password); match || err != nil {
+		return match, err
+	}
+	for i, hash := range u.history {
+		if i >= n-1 {
+			break
+		}
+		h, err := hasherOf(hash)
+		if err != nil {
+			return false, err
+		}
+		if match, err := h.Verify(password, hash); match || err != nil {
+			return match, err
+		}
+	}
+	return false, nil
+}
+
+// needsRehash reports if the hash of a user should be upgraded to Hasher.
+func (u User) needsRehash() bool {
+	return u.isLegacy() || Hasher.NeedsRehash(u.hash)
+}
+
+// isLegacy reports if the user has an HMAC-SHA256 hash. Only legacy users
+// have a secret.
+func (u User) isLegacy() bool {
+	return u.secret != ""
+}
+
+func randomBytes(n uint32) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func encodeSegment(b []byte) string {
+	return base64.RawStdEncoding.EncodeToString(b)
+}
+
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(s)
+}
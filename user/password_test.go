@@ -0,0 +1,99 @@
+package user
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/openspock/crypto/hashes"
+)
+
+func TestPasswordHashers(t *testing.T) {
+	for _, algorithm := range []string{"argon2id", "bcrypt", "scrypt"} {
+		h, err := NewHasher(algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := h.Hash("password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifier, err := hasherOf(encoded)
+		if err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+		if ok, err := verifier.Verify("password", encoded); !ok || err != nil {
+			t.Errorf("%s: password should match %s: %v", algorithm, encoded, err)
+		}
+		if ok, _ := verifier.Verify("wrong", encoded); ok {
+			t.Errorf("%s: wrong password should not match", algorithm)
+		}
+		if h.NeedsRehash(encoded) {
+			t.Errorf("%s: hash made with the same parameters should not need a rehash", algorithm)
+		}
+	}
+
+	weaker := Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, SaltLength: 16, KeyLength: 32}
+	encoded, err := weaker.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !DefaultArgon2idHasher.NeedsRehash(encoded) {
+		t.Error("hash made with other parameters should need a rehash")
+	}
+	if ok, err := DefaultArgon2idHasher.Verify("password", encoded); !ok || err != nil {
+		t.Errorf("hash made with other parameters should still verify: %v", err)
+	}
+}
+
+func TestAuthenticateUpgradesLegacyHash(t *testing.T) {
+	dir := t.TempDir()
+	d, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	role, err := d.CreateRole("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, salt := "12345678", "c2FsdHNhbHQ="
+	hash, err := hashes.CalculateHmacSha256([]byte("password"+salt), []byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := &User{UserID: "legacy-user", secret: secret, Salt: salt, hash: string(hash), Email: "legacy@openspock.org", RoleID: role.RoleID}
+	if err := d.config.WriteUser(legacy); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Authenticate("legacy@openspock.org", "wrong", ""); err == nil {
+		t.Fatal("wrong password should not authenticate")
+	}
+	if u, _ := d.User("legacy@openspock.org"); !u.isLegacy() {
+		t.Fatal("failed login should not upgrade the hash")
+	}
+	if err := d.Authenticate("legacy@openspock.org", "password", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := reopened.User("legacy@openspock.org")
+	if u.isLegacy() || u.Salt != "" || !strings.HasPrefix(u.hash, "$argon2id$") {
+		t.Errorf("legacy hash should have been upgraded to argon2id, got %q", u.hash)
+	}
+	if err := reopened.Authenticate("legacy@openspock.org", "password", ""); err != nil {
+		t.Error(err)
+	}
+}
+
+// useFastHasher hashes passwords with cheap parameters for the rest of a test.
+func useFastHasher(t *testing.T) {
+	h := Hasher
+	t.Cleanup(func() { Hasher = h })
+	Hasher = Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, SaltLength: 16, KeyLength: 32}
+}
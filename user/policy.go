@@ -0,0 +1,171 @@
+package user
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// PasswordPolicy is the set of rules passwords of new users and changed
+// passwords have to follow. It is configured in the settings of a location:
+//
+//	password.min_length      minimum number of characters, 8 by default
+//	password.require_upper   require an upper case letter
+//	password.require_lower   require a lower case letter
+//	password.require_digit   require a digit
+//	password.require_symbol  require a character which is neither a letter
+//	                         nor a digit
+//	password.banned_file     file of banned passwords, one per line, relative
+//	                         to the location
+//	password.history         number of most recent passwords of a user,
+//	                         including the current one, which can't be reused
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// Banned holds lower cased banned passwords.
+	Banned  map[string]bool
+	History int
+}
+
+// PolicyViolation is a rule of the password policy which a password breaks.
+type PolicyViolation struct {
+	// Rule is the name of the setting of the rule, for e.g. min_length.
+	Rule    string
+	Message string
+}
+
+// PasswordPolicyError lists every rule of the password policy which a
+// password breaks.
+type PasswordPolicyError struct {
+	Violations []PolicyViolation
+}
+
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		messages = append(messages, v.Message)
+	}
+	return "password does not meet the password policy: " + strings.Join(messages, "; ")
+}
+
+// Is reports whether target is ErrInvalid, a password which breaks the
+// policy is invalid input.
+func (e *PasswordPolicyError) Is(target error) bool {
+	return target == ErrInvalid
+}
+
+// newPasswordPolicy builds the password policy of settings. Relative paths
+// are resolved against dir.
+func newPasswordPolicy(s Settings, dir string) (PasswordPolicy, error) {
+	var p PasswordPolicy
+	var err error
+	if p.MinLength, err = s.Int("password.min_length", 8); err != nil {
+		return p, err
+	}
+	if p.RequireUpper, err = s.Bool("password.require_upper", false); err != nil {
+		return p, err
+	}
+	if p.RequireLower, err = s.Bool("password.require_lower", false); err != nil {
+		return p, err
+	}
+	if p.RequireDigit, err = s.Bool("password.require_digit", false); err != nil {
+		return p, err
+	}
+	if p.RequireSymbol, err = s.Bool("password.require_symbol", false); err != nil {
+		return p, err
+	}
+	if p.History, err = s.Int("password.history", 0); err != nil {
+		return p, err
+	}
+	if file := s.String("password.banned_file", ""); file != "" {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		if p.Banned, err = readBannedPasswords(file); err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+// readBannedPasswords reads a file of banned passwords, one per line. Empty
+// lines and lines starting with # are skipped.
+func readBannedPasswords(file string) (map[string]bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	banned := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		banned[strings.ToLower(line)] = true
+	}
+	return banned, scanner.Err()
+}
+
+// check returns a *PasswordPolicyError if password breaks the policy. If u
+// is set, password must also differ from the recent passwords of u.
+func (p PasswordPolicy) check(password string, u *User) error {
+	var violations []PolicyViolation
+	violate := func(rule, message string) {
+		violations = append(violations, PolicyViolation{rule, message})
+	}
+
+	if n := len([]rune(password)); n < p.MinLength {
+		violate("min_length", "must be at least "+strconv.Itoa(p.MinLength)+" characters long")
+	}
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case !unicode.IsLetter(r):
+			symbol = true
+		}
+	}
+	if p.RequireUpper && !upper {
+		violate("require_upper", "must contain an upper case letter")
+	}
+	if p.RequireLower && !lower {
+		violate("require_lower", "must contain a lower case letter")
+	}
+	if p.RequireDigit && !digit {
+		violate("require_digit", "must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		violate("require_symbol", "must contain a symbol")
+	}
+	if p.Banned[strings.ToLower(password)] {
+		violate("banned", "is a commonly used password")
+	}
+	if u != nil && p.History > 0 {
+		reused, err := u.usedPassword(password, p.History)
+		if err != nil {
+			return err
+		}
+		if reused {
+			violate("history", "must not be one of the last "+strconv.Itoa(p.History)+" passwords")
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{violations}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package user
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	dir := t.TempDir()
+	settings := "# password policy\npassword.min_length,10\npassword.require_digit,true\npassword.require_symbol, true\npassword.banned_file,banned.txt\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "userd.conf"), []byte(settings), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "banned.txt"), []byte("# leaked\nPassw0rd!123\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	role, err := d.CreateRole("policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for password, rules := range map[string][]string{
+		"":             {"min_length", "require_digit", "require_symbol"},
+		"short1!":      {"min_length"},
+		"longenough1":  {"require_symbol"},
+		"passw0rd!123": {"banned"},
+	} {
+		err := d.CreateUser("policy@openspock.org", password, "policy user", role.RoleID)
+		pe, ok := err.(*PasswordPolicyError)
+		if !ok {
+			t.Errorf("%q: expected a *PasswordPolicyError, got %v", password, err)
+			continue
+		}
+		if len(pe.Violations) != len(rules) {
+			t.Errorf("%q: expected violations %v, got %v", password, rules, pe.Violations)
+			continue
+		}
+		for i, rule := range rules {
+			if pe.Violations[i].Rule != rule {
+				t.Errorf("%q: expected violations %v, got %v", password, rules, pe.Violations)
+			}
+		}
+	}
+	if err := d.CreateUser("policy@openspock.org", "long-enough-1", "policy user", role.RoleID); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPasswordHistory(t *testing.T) {
+	useFastHasher(t)
+
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "userd.conf"), []byte("password.history,3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Initialize("history@openspock.org", "password1"); err != nil {
+		t.Fatal(err)
+	}
+	change := func(from, to string) error {
+		return d.ChangePassword("history@openspock.org", from, "", to, to)
+	}
+	if err := change("password1", "password1"); err == nil {
+		t.Error("current password should not be reusable")
+	}
+	if err := change("password1", "password2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := change("password2", "password3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := change("password3", "password1").(*PasswordPolicyError); !ok {
+		t.Error("one of the last 3 passwords should not be reusable")
+	}
+	if err := change("password3", "password4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := change("password4", "password1"); err != nil {
+		t.Errorf("passwords older than the last 3 should be reusable: %v", err)
+	}
+
+	// the history survives reloading the location
+	reopened, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.ChangePassword("history@openspock.org", "password1", "", "password4", "password4"); err == nil {
+		t.Error("history should be persisted")
+	}
+}
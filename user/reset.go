@@ -0,0 +1,118 @@
+package user
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/openspock/log"
+)
+
+// errInvalidResetToken is returned for reset tokens which are wrong, expired
+// or already used.
+var errInvalidResetToken = newError(ErrBadCredentials, "reset token is invalid or has expired")
+
+// resetToken is an outstanding password reset of a user. Only a hash of the
+// token is kept, a user has at most one outstanding reset.
+type resetToken struct {
+	hash    string
+	expires time.Time
+}
+
+func (r resetToken) matches(token string, now time.Time) bool {
+	return r.hash != "" && now.Before(r.expires) && subtle.ConstantTimeCompare([]byte(r.hash), []byte(hashToken(token))) == 1
+}
+
+// IssueResetToken issues a single use token which lets a user who forgot
+// their password set a new one with ResetPassword. Issuing a token replaces
+// the outstanding one. The token expires after password.reset_ttl in the
+// settings of the location, 24h by default.
+func (d *Directory) IssueResetToken(email string) (string, time.Time, error) {
+	log.Info("IssueResetToken", log.AppMsg, map[string]interface{}{"email": email})
+
+	ttl, err := d.snapshot().settings.Duration("password.reset_ttl", 24*time.Hour)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	secret, err := randomBytes(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+	expires := time.Now().Add(ttl)
+	err = d.updateUser(email, func(u *User) error {
+		if u.Service {
+			return newError(ErrInvalid, email+" is a service account, it has no password")
+		}
+		u.reset = resetToken{hashToken(token), expires}
+		return nil
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	log.Info("IssueResetToken", log.AppMsg, map[string]interface{}{"email": email, "expires": expires.Format(time.RFC3339), "result": "success", "message": "reset token issued for " + email})
+	return token, expires, nil
+}
+
+// ResetPassword sets a new password for a user with a reset token issued by
+// IssueResetToken. The token is used up, the lockout of the user is lifted
+// and their sessions are revoked. Passwords which break the password policy
+// of the location are rejected with a *PasswordPolicyError, the token stays
+// valid then.
+func (d *Directory) ResetPassword(email, token, newPassword, confirmPassword string) error {
+	return d.ResetPasswordFrom("", email, token, newPassword, confirmPassword)
+}
+
+// ResetPasswordFrom resets the password for a user with a reset token sent
+// from source. Wrong tokens count as failed attempts of source, see
+// AuthenticateFrom. They don't count for the account, which may be locked out
+// already.
+func (d *Directory) ResetPasswordFrom(source, email, token, newPassword, confirmPassword string) error {
+	log.Info("ResetPassword", log.AppMsg, map[string]interface{}{"email": email, "source": source})
+
+	if newPassword != confirmPassword {
+		return newError(ErrInvalid, "new and confirm password not the same")
+	}
+
+	now := time.Now()
+	if err := d.checkAttempts(source, User{}, now); err != nil {
+		return err
+	}
+	if v, ok := d.User(email); !ok || !v.reset.matches(token, now) {
+		d.recordFailure(source, "", now)
+		log.Info("ResetPassword", log.AppMsg, map[string]interface{}{"email": email, "source": source, "result": "failure", "message": errInvalidResetToken.Error()})
+		return errInvalidResetToken
+	}
+
+	if err := d.redeemResetToken(email, token, newPassword, now); err != nil {
+		return err
+	}
+	d.recordSuccess(source, "")
+
+	log.Info("ResetPassword", log.AppMsg, map[string]interface{}{"email": email, "source": source, "result": "success", "message": "password reset for " + email})
+	return nil
+}
+
+// redeemResetToken sets the new password if the token is still outstanding.
+// The token is checked and consumed under the store's lock, so that it can't
+// be redeemed twice, not even by two processes at once.
+func (d *Directory) redeemResetToken(email, token, newPassword string, now time.Time) error {
+	t := d.snapshot()
+	err := d.commitUser(email, func(u *User) ([]Mutation, error) {
+		if !u.reset.matches(token, now) {
+			return nil, errInvalidResetToken
+		}
+		if err := t.setNewPassword(u, newPassword); err != nil {
+			return nil, err
+		}
+		u.reset = resetToken{}
+		u.attempts = attempts{}
+		return t.sessionsOf(email), nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return errInvalidResetToken
+	}
+	return err
+}
@@ -0,0 +1,73 @@
+package user
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResetPassword(t *testing.T) {
+	d, dir := openWithSettings(t, "lockout.threshold,2\nthrottle.delay,0s\npassword.history,2\n")
+	if err := d.Initialize("reset@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	session, err := d.CreateSession("", "reset@openspock.org", "password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		d.Authenticate("reset@openspock.org", "forgotten", "")
+	}
+	if err := d.Authenticate("reset@openspock.org", "password", ""); err != errAccountLocked {
+		t.Fatalf("expected the account to be locked, got %v", err)
+	}
+
+	token, expires, err := d.IssueResetToken("reset@openspock.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expires.After(time.Now().Add(23 * time.Hour)) {
+		t.Errorf("reset token should expire after 24h by default, expires %s", expires)
+	}
+	if err := d.ResetPassword("reset@openspock.org", "wrong", "password2", "password2"); err != errInvalidResetToken {
+		t.Errorf("expected a wrong reset token to be rejected, got %v", err)
+	}
+	if err := d.ResetPassword("reset@openspock.org", token, "password", "password"); err == nil {
+		t.Error("reset password should follow the password history")
+	}
+
+	reopened, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.ResetPassword("reset@openspock.org", token, "password2", "password2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Authenticate("reset@openspock.org", "password2", ""); err != nil {
+		t.Errorf("reset should set the new password and lift the lockout: %v", err)
+	}
+	if err := reopened.ResetPassword("reset@openspock.org", token, "password3", "password3"); err != errInvalidResetToken {
+		t.Errorf("expected a used reset token to be rejected, got %v", err)
+	}
+	// d still holds the token in its snapshot
+	if err := d.ResetPassword("reset@openspock.org", token, "password3", "password3"); err != errInvalidResetToken {
+		t.Errorf("expected a token used by another process to be rejected, got %v", err)
+	}
+	if _, err := reopened.Introspect(session); err != errInvalidToken {
+		t.Errorf("expected the reset to revoke all sessions, got %v", err)
+	}
+}
+
+func TestResetTokenExpiry(t *testing.T) {
+	d, _ := openWithSettings(t, "password.reset_ttl,100ms\n")
+	if err := d.Initialize("expired@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := d.IssueResetToken("expired@openspock.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := d.ResetPassword("expired@openspock.org", token, "password2", "password2"); err != errInvalidResetToken {
+		t.Errorf("expected an expired reset token to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package user
+
+import (
+	"sort"
+	"strings"
+)
+
+// Resources of file permissions are patterns made of segments separated by
+// "/". A * segment matches exactly one non-empty segment of a resource and a
+// ** segment matches any number of segments, none included. Other segments,
+// as well as segments which merely contain a *, match literally. For e.g.
+//
+//	/data/reports                  matches /data/reports only
+//	/data/reports/**               matches /data/reports and everything below it
+//	https://api.example.com/v1/*   matches https://api.example.com/v1/users
+//	                               but not https://api.example.com/v1/users/7
+const (
+	anySegment  = "*"
+	anySegments = "**"
+)
+
+// resourceTrie indexes the resource patterns of file permissions by their
+// segments, so that the patterns matching a resource are found without
+// looking at every file permission.
+type resourceTrie struct {
+	children map[string]*resourceTrie
+	// pattern is the pattern ending at this node, if any
+	pattern string
+	end     bool
+}
+
+func newResourceTrie() *resourceTrie {
+	return &resourceTrie{children: make(map[string]*resourceTrie)}
+}
+
+// insert adds a pattern to the trie.
+func (n *resourceTrie) insert(pattern string) {
+	for _, segment := range strings.Split(pattern, "/") {
+		child, ok := n.children[segment]
+		if !ok {
+			child = newResourceTrie()
+			n.children[segment] = child
+		}
+		n = child
+	}
+	n.pattern, n.end = pattern, true
+}
+
+// match returns the patterns which match resource, most specific first, see
+// moreSpecific.
+func (n *resourceTrie) match(resource string) []string {
+	found := make(map[string]bool)
+	n.walk(strings.Split(resource, "/"), found)
+	patterns := make([]string, 0, len(found))
+	for p := range found {
+		patterns = append(patterns, p)
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		return moreSpecific(patterns[i], patterns[j])
+	})
+	return patterns
+}
+
+func (n *resourceTrie) walk(segments []string, found map[string]bool) {
+	if rest, ok := n.children[anySegments]; ok {
+		for i := 0; i <= len(segments); i++ {
+			rest.walk(segments[i:], found)
+		}
+	}
+	if len(segments) == 0 {
+		if n.end {
+			found[n.pattern] = true
+		}
+		return
+	}
+	if child, ok := n.children[segments[0]]; ok {
+		child.walk(segments[1:], found)
+	}
+	if child, ok := n.children[anySegment]; ok && segments[0] != "" {
+		child.walk(segments[1:], found)
+	}
+}
+
+// moreSpecific reports whether pattern a is more specific than pattern b. A
+// pattern without wildcards is the most specific, otherwise the pattern with
+// more literal segments, then fewer ** segments and then fewer * segments is
+// more specific. Remaining ties are broken by the longer pattern and finally
+// by order, so that the most specific pattern is always the same.
+func moreSpecific(a, b string) bool {
+	ca, cb := countSegments(a), countSegments(b)
+	exactA, exactB := ca.any+ca.anySegments == 0, cb.any+cb.anySegments == 0
+	switch {
+	case exactA != exactB:
+		return exactA
+	case ca.literal != cb.literal:
+		return ca.literal > cb.literal
+	case ca.anySegments != cb.anySegments:
+		return ca.anySegments < cb.anySegments
+	case ca.any != cb.any:
+		return ca.any < cb.any
+	case len(a) != len(b):
+		return len(a) > len(b)
+	}
+	return a < b
+}
+
+type segmentCounts struct {
+	literal, any, anySegments int
+}
+
+func countSegments(pattern string) segmentCounts {
+	var c segmentCounts
+	for _, segment := range strings.Split(pattern, "/") {
+		switch segment {
+		case anySegment:
+			c.any++
+		case anySegments:
+			c.anySegments++
+		default:
+			c.literal++
+		}
+	}
+	return c
+}
+
+// matchFPs returns the file permissions granted to grantees, see grantee,
+// whose resource matches resource. File permissions of more specific
+// patterns come first.
+func (t *tables) matchFPs(resource string, grantees ...string) []FilePermission {
+	var fps []FilePermission
+	for _, g := range grantees {
+		trie, ok := t.resources[g]
+		if !ok {
+			continue
+		}
+		for _, pattern := range trie.match(resource) {
+			fps = append(fps, t.fps[g][pattern]...)
+		}
+	}
+	sort.SliceStable(fps, func(i, j int) bool {
+		return moreSpecific(fps[i].File, fps[j].File)
+	})
+	return fps
+}
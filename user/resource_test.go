@@ -0,0 +1,87 @@
+package user
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResourceTrie(t *testing.T) {
+	trie := newResourceTrie()
+	for _, p := range []string{"/data/reports", "/data/reports/**", "/data/*/q3.csv", "/data/**", "https://api.example.com/v1/*", "/logs/**/error.log"} {
+		trie.insert(p)
+	}
+	for resource, expected := range map[string][]string{
+		"/data/reports":                      {"/data/reports", "/data/reports/**", "/data/**"},
+		"/data/reports/q3.csv":               {"/data/*/q3.csv", "/data/reports/**", "/data/**"},
+		"/data/sales/q3.csv":                 {"/data/*/q3.csv", "/data/**"},
+		"/data":                              {"/data/**"},
+		"/database":                          nil,
+		"https://api.example.com/v1/users":   {"https://api.example.com/v1/*"},
+		"https://api.example.com/v1/users/7": nil,
+		"https://api.example.com/v1/":        nil,
+		"/logs/error.log":                    {"/logs/**/error.log"},
+		"/logs/app/2024/error.log":           {"/logs/**/error.log"},
+	} {
+		if matched := trie.match(resource); !(len(matched) == 0 && len(expected) == 0) && !reflect.DeepEqual(matched, expected) {
+			t.Errorf("%s: expected %v, got %v", resource, expected, matched)
+		}
+	}
+}
+
+func TestMostSpecificMatch(t *testing.T) {
+	d, _ := openWithSettings(t, "")
+	if err := d.Initialize("glob@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := d.User("glob@openspock.org")
+	grant := func(resource string, actions ...string) {
+		if _, err := d.CreateFP(resource, &u, &Role{}, actions, time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	grant("/data/**", ActionRead, ActionWrite)
+	grant("/data/secret/**", ActionRead)
+	grant("/data/secret/shared.txt", ActionRead, ActionWrite)
+	if _, err := d.CreateFP("/data/reports/old/**", &u, &Role{}, []string{ActionRead}, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	authorize := func(resource, action string) error {
+		return d.Authorize("glob@openspock.org", "password", "", resource, action)
+	}
+	for _, allowed := range []struct{ resource, action string }{
+		{"/data/reports/q3.csv", ActionWrite},
+		{"/data/secret/plans.txt", ActionRead},
+		{"/data/secret/shared.txt", ActionWrite},
+		{"/data/reports/old/q1.csv", ActionWrite},
+		// the narrow read grant doesn't take the broader write grant away
+		{"/data/secret/plans.txt", ActionWrite},
+	} {
+		if err := authorize(allowed.resource, allowed.action); err != nil {
+			t.Errorf("%s on %s should be allowed: %v", allowed.action, allowed.resource, err)
+		}
+	}
+	e, err := d.Explain("glob@openspock.org", "/data/secret/plans.txt", ActionWrite)
+	if err != nil || e.Pattern != "/data/**" {
+		t.Errorf("expected the broader grant to decide, got %+v, %v", e, err)
+	}
+
+	// a deny takes it away
+	if _, err := d.DenyFP("/data/secret/**", &u, &Role{}, []string{ActionWrite}, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := authorize("/data/secret/plans.txt", ActionWrite); !errors.Is(err, ErrNotAuthorized) {
+		t.Errorf("the deny should override the broader grant, got %v", err)
+	}
+	if err := authorize("/data/secret/plans.txt", ActionRead); err != nil {
+		t.Errorf("the deny should only cover write: %v", err)
+	}
+	if err := authorize("/data/secret/shared.txt", ActionWrite); err != nil {
+		t.Errorf("the more specific grant should override the deny: %v", err)
+	}
+	if err := authorize("/other/file", ActionRead); !errors.Is(err, ErrNotAuthorized) {
+		t.Errorf("resources without a matching grant should not be allowed, got %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package user
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/openspock/log"
+)
+
+// ancestors returns the RoleIDs of a role and of all roles it inherits from.
+// Parents which no longer exist are skipped.
+func (t *tables) ancestors(roleID string) map[string]bool {
+	roles := make(map[string]bool)
+	pending := []string{roleID}
+	for len(pending) > 0 {
+		id := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		r, ok := t.roles[id]
+		if !ok || roles[id] {
+			continue
+		}
+		roles[id] = true
+		pending = append(pending, r.Parents...)
+	}
+	return roles
+}
+
+// checkParents returns an error if a role can't inherit from parents, because
+// a parent does not exist or because the role would inherit from itself.
+func (t *tables) checkParents(roleID string, parents []string) error {
+	for _, p := range parents {
+		if _, ok := t.roles[p]; !ok {
+			return newError(ErrNotFound, p+" does not exist")
+		}
+		if p == roleID || t.ancestors(p)[roleID] {
+			return newError(ErrInvalid, "inheriting from "+t.roles[p].Name+" would make "+t.roles[roleID].Name+" inherit from itself")
+		}
+	}
+	return nil
+}
+
+// SetRoleParents sets the roles a role inherits from. Roles can't inherit from
+// themselves, directly or through other roles.
+func (d *Directory) SetRoleParents(roleID string, parents []string) error {
+	log.Info("SetRoleParents", log.AppMsg, map[string]interface{}{"role_id": roleID, "parents": strings.Join(parents, ",")})
+
+	// parents are checked against the current roles
+	if err := d.Reload(); err != nil {
+		return err
+	}
+	t := d.snapshot()
+	if err := t.checkParents(roleID, parents); err != nil {
+		return err
+	}
+	var name string
+	err := d.updateRole(roleID, func(r *Role) error {
+		r.Parents, name = parents, r.Name
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info("SetRoleParents", log.AppMsg, map[string]interface{}{"role_id": roleID, "parents": strings.Join(parents, ","), "result": "success", "message": "parents of " + name + " have been set"})
+	return nil
+}
+
+// updateRole persists a change to a role. The role is read and written under
+// the store's exclusive lock, so that a concurrent change to another field of
+// the role by another process isn't undone. Nothing is written if update
+// returns an error.
+func (d *Directory) updateRole(roleID string, update func(*Role) error) error {
+	err := d.config.UpdateRole(roleID, func(r *Role) ([]Mutation, error) {
+		return nil, update(r)
+	})
+	if err != nil {
+		return err
+	}
+	return d.Reload()
+}
+
+// effectiveRoles returns the RoleIDs of all roles a user holds, directly or
+// through inheritance.
+func (t *tables) effectiveRoles(u User) map[string]bool {
+	roles := t.ancestors(u.RoleID)
+	for _, roleID := range u.Roles {
+		for id := range t.ancestors(roleID) {
+			roles[id] = true
+		}
+	}
+	return roles
+}
+
+// EffectiveRoles returns all roles a user holds, directly or through
+// inheritance, sorted by name.
+func (d *Directory) EffectiveRoles(email string) ([]Role, error) {
+	t := d.snapshot()
+	u, ok := t.users[email]
+	if !ok {
+		return nil, newError(ErrNotFound, email+" does not exist")
+	}
+	var roles []Role
+	for roleID := range t.effectiveRoles(u) {
+		roles = append(roles, t.roles[roleID])
+	}
+	sort.Slice(roles, func(i, j int) bool {
+		return roles[i].Name < roles[j].Name
+	})
+	return roles, nil
+}
+
+// AddUserRole lets a user hold a role besides the roles they already hold.
+func (d *Directory) AddUserRole(email, roleID string) error {
+	log.Info("AddUserRole", log.AppMsg, map[string]interface{}{"email": email, "role_id": roleID})
+
+	if err := d.updateUser(email, func(u *User) error {
+		r, ok := d.Role(roleID)
+		if !ok {
+			return newError(ErrNotFound, roleID+" does not exist")
+		}
+		if u.RoleID == roleID || contains(u.Roles, roleID) {
+			return newError(ErrExists, email+" already holds "+r.Name)
+		}
+		u.Roles = append(u.Roles, roleID)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	log.Info("AddUserRole", log.AppMsg, map[string]interface{}{"email": email, "role_id": roleID, "result": "success", "message": roleID + " has been added to " + email})
+	return nil
+}
+
+// RemoveUserRole removes a role added with AddUserRole from a user. The role
+// a user was created with can't be removed.
+func (d *Directory) RemoveUserRole(email, roleID string) error {
+	log.Info("RemoveUserRole", log.AppMsg, map[string]interface{}{"email": email, "role_id": roleID})
+
+	if err := d.updateUser(email, func(u *User) error {
+		if u.RoleID == roleID {
+			return newError(ErrInvalid, roleID+" is the role "+email+" was created with, it can't be removed")
+		}
+		if !contains(u.Roles, roleID) {
+			return newError(ErrNotFound, email+" does not hold "+roleID)
+		}
+		u.Roles = remove(u.Roles, roleID)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	log.Info("RemoveUserRole", log.AppMsg, map[string]interface{}{"email": email, "role_id": roleID, "result": "success", "message": roleID + " has been removed from " + email})
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// remove returns values without value.
+func remove(values []string, value string) []string {
+	var kept []string
+	for _, v := range values {
+		if v != value {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,138 @@
+package user
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRoleHierarchy(t *testing.T) {
+	d, dir := openWithSettings(t, "")
+	if err := d.Initialize("admin@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	analyst, err := d.CreateRole("analyst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CreateRole("lead", "no-such-role"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected unknown parents to be rejected, got %v", err)
+	}
+	senior, err := d.CreateRole("senior-analyst", analyst.RoleID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateUser("senior@openspock.org", "password", "", senior.RoleID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CreateFP("/data/reports/**", &User{}, analyst, []string{ActionRead}, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CreateFP("/data/forecasts/**", &User{}, senior, []string{ActionRead}, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Authorize("senior@openspock.org", "password", "", "/data/reports/q3.csv", ActionRead); err != nil {
+		t.Errorf("grants of a parent role should apply to members of the child role: %v", err)
+	}
+	if err := reopened.CreateUser("analyst@openspock.org", "password", "", analyst.RoleID); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Authorize("analyst@openspock.org", "password", "", "/data/forecasts/q3.csv", ActionRead); !errors.Is(err, ErrRoleMismatch) {
+		t.Errorf("grants of a child role should not apply to members of the parent role, got %v", err)
+	}
+
+	if err := reopened.SetRoleParents(analyst.RoleID, []string{senior.RoleID}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("expected a cycle to be rejected, got %v", err)
+	}
+	if err := reopened.SetRoleParents(analyst.RoleID, []string{analyst.RoleID}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("expected a role inheriting from itself to be rejected, got %v", err)
+	}
+
+	admin, _ := reopened.Role(reopened.snapshot().users["admin@openspock.org"].RoleID)
+	if err := reopened.SetRoleParents(senior.RoleID, []string{analyst.RoleID, admin.RoleID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.AuthenticateForRole("senior@openspock.org", "password", "", Admin); err != nil {
+		t.Errorf("roles inheriting from admin should be admins: %v", err)
+	}
+	if err := reopened.AuthenticateForRole("analyst@openspock.org", "password", "", Admin); !errors.Is(err, ErrRoleMismatch) {
+		t.Errorf("expected analysts not to be admins, got %v", err)
+	}
+}
+
+func TestRoleTOTPIsInherited(t *testing.T) {
+	d, _ := openWithSettings(t, "")
+	if err := d.Initialize("admin@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	operator, err := d.CreateRole("operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oncall, err := d.CreateRole("oncall", operator.RoleID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateUser("oncall@openspock.org", "password", "", oncall.RoleID); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RequireRoleTOTP(operator.RoleID, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Authenticate("oncall@openspock.org", "password", ""); err != errSecondFactorRequired {
+		t.Errorf("expected a role to require the second factor of the role it inherits from, got %v", err)
+	}
+}
+
+func TestRoleChangesDoNotRevertEachOther(t *testing.T) {
+	d, dir := openWithSettings(t, "")
+	if err := d.Initialize("admin@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	operator, err := d.CreateRole("operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oncall, err := d.CreateRole("oncall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two directories stand in for two processes, neither sees the change
+	// of the other before making its own
+	other, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RequireRoleTOTP(oncall.RoleID, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.SetRoleParents(oncall.RoleID, []string{operator.RoleID}); err != nil {
+		t.Fatal(err)
+	}
+	stale, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := stale.Role(oncall.RoleID); len(r.Parents) != 1 || !r.RequireTOTP {
+		t.Errorf("expected parents and totp requirement to be kept, got %+v", r)
+	}
+	if err := d.SetRoleParents(oncall.RoleID, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := stale.RequireRoleTOTP(oncall.RoleID, false); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := reopened.Role(oncall.RoleID); len(r.Parents) != 0 || r.RequireTOTP {
+		t.Errorf("expected cleared parents and totp requirement to be kept, got %+v", r)
+	}
+}
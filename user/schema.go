@@ -0,0 +1,228 @@
+package user
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// schemaHeader marks the first row of a conf file which holds the kind of the
+// conf file and the schema version of its records:
+//
+//	#userd,user,2
+//
+// Conf files without a header have schema version 1.
+const schemaHeader = "#userd"
+
+// migration upgrades the fields of a record from one schema version to the
+// next.
+type migration func(fields []string) ([]string, error)
+
+// schema describes the layout of the records of a conf file across all
+// versions.
+type schema struct {
+	kind string
+	// fields holds the number of record fields per schema version, starting
+	// with version 1. Every row is followed by a version and an operation
+	// column, version 1 rows may omit both.
+	fields []int
+	// migrations[i] upgrades records from version i+1 to version i+2.
+	migrations []migration
+	// key returns the key of a record in the current version.
+	key func([]string) string
+	// sensitive holds the indexes of fields which are encrypted at rest.
+	sensitive []int
+}
+
+// Schemas of the userd conf files. Adding a field to a record means appending
+// the new field count and a migration which fills in the field for older
+// records.
+var (
+	userSchema = schema{
+		kind:       "user",
+		fields:     []int{8, 8, 8, 9, 11, 15, 16, 18, 20, 22},
+		migrations: []migration{addHeader, encodeUserSecrets, addPasswordHistory, addFailedAttempts, addUserTOTP, addServiceAccount, addResetToken, addAccountStatus, addRolesAndGroups},
+		key:        func(f []string) string { return f[4] },
+		sensitive:  []int{1, 2, 3, 8, 12, 13, 16},
+	}
+	roleSchema = schema{
+		kind:       "role",
+		fields:     []int{2, 2, 3, 4},
+		migrations: []migration{addHeader, addRoleTOTP, addRoleParents},
+		key:        func(f []string) string { return f[0] },
+	}
+	filePermissionSchema = schema{
+		kind:       "filepermission",
+		fields:     []int{5, 5, 6, 7, 8},
+		migrations: []migration{addHeader, addFPActions, addFPGroup, addFPDeny},
+		key:        func(f []string) string { return f[0] + "|" + f[1] + "|" + f[2] + "|" + f[6] + "|" + f[7] },
+	}
+	sessionSchema = schema{
+		kind:      "session",
+		fields:    []int{6},
+		key:       func(f []string) string { return f[0] },
+		sensitive: []int{5},
+	}
+	apiKeySchema = schema{
+		kind:      "apikey",
+		fields:    []int{7},
+		key:       func(f []string) string { return f[0] },
+		sensitive: []int{6},
+	}
+	certMappingSchema = schema{
+		kind:   "certmapping",
+		fields: []int{2},
+		key:    func(f []string) string { return f[0] },
+	}
+)
+
+// version returns the current schema version.
+func (s schema) version() int {
+	return len(s.fields)
+}
+
+// header returns the header row for the current schema version.
+func (s schema) header() []string {
+	return []string{schemaHeader, s.kind, strconv.Itoa(s.version())}
+}
+
+// parseHeader returns the schema version of a header row.
+func (s schema) parseHeader(record []string) (int, error) {
+	if len(record) != 3 || record[1] != s.kind {
+		return 0, fmt.Errorf("invalid header, expected %s,%s,<version>", schemaHeader, s.kind)
+	}
+	version, err := strconv.Atoi(record[2])
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("invalid schema version %q", record[2])
+	}
+	if version > s.version() {
+		return 0, fmt.Errorf("schema version %d is newer than the supported version %d, please upgrade userd", version, s.version())
+	}
+	return version, nil
+}
+
+// parseRow parses a record written with schema version into a row with
+// fields in the current schema version.
+func (s schema) parseRow(record []string, version int) (row, error) {
+	n := s.fields[version-1]
+	var r row
+	switch {
+	case len(record) == n+2:
+		v, err := strconv.ParseInt(record[n], 10, 64)
+		if err != nil {
+			return row{}, fmt.Errorf("invalid version %q", record[n])
+		}
+		op := record[n+1]
+		if op != opPut && op != opDelete {
+			return row{}, fmt.Errorf("invalid operation %q", op)
+		}
+		r = row{fields: record[:n], version: v, deleted: op == opDelete}
+	case len(record) == n && version == 1:
+		r = row{fields: record}
+	default:
+		return row{}, fmt.Errorf("expected %d fields for a %s record, got %d", n+2, s.kind, len(record))
+	}
+
+	for _, m := range s.migrations[version-1:] {
+		fields, err := m(r.fields)
+		if err != nil {
+			return row{}, err
+		}
+		r.fields = fields
+	}
+	if len(r.fields) != s.fields[len(s.fields)-1] {
+		return row{}, errors.New("migration of " + s.kind + " record produced an invalid record")
+	}
+	return r, nil
+}
+
+// addHeader upgrades records to version 2. Version 2 only introduced the
+// schema header and makes the version and operation columns mandatory, the
+// fields stay the same.
+func addHeader(fields []string) ([]string, error) {
+	return fields, nil
+}
+
+// encodeUserSecrets upgrades user records to version 3. Version 2 stored the
+// secret and hash as raw bytes, version 3 stores them base64 encoded so that
+// they survive the csv round trip and can be encrypted.
+func encodeUserSecrets(fields []string) ([]string, error) {
+	fields[1] = base64.StdEncoding.EncodeToString([]byte(fields[1]))
+	fields[3] = base64.StdEncoding.EncodeToString([]byte(fields[3]))
+	return fields, nil
+}
+
+// addPasswordHistory upgrades user records to version 4 which adds the
+// hashes of previous passwords. Older records have no history.
+func addPasswordHistory(fields []string) ([]string, error) {
+	return append(fields, ""), nil
+}
+
+// addFailedAttempts upgrades user records to version 5 which adds the number
+// and time of consecutive failed authentication attempts.
+func addFailedAttempts(fields []string) ([]string, error) {
+	return append(fields, "0", ""), nil
+}
+
+// addUserTOTP upgrades user records to version 6 which adds the second
+// factor: whether it is required, the TOTP secret, the hashes of unused
+// recovery codes and the last accepted time step.
+func addUserTOTP(fields []string) ([]string, error) {
+	return append(fields, "false", "", "", "0"), nil
+}
+
+// addRoleTOTP upgrades role records to version 3 which adds whether users of
+// the role are required to use a second factor.
+func addRoleTOTP(fields []string) ([]string, error) {
+	return append(fields, "false"), nil
+}
+
+// addServiceAccount upgrades user records to version 7 which adds whether
+// the user is a service account.
+func addServiceAccount(fields []string) ([]string, error) {
+	return append(fields, "false"), nil
+}
+
+// addResetToken upgrades user records to version 8 which adds the hash and
+// expiry of an outstanding password reset token.
+func addResetToken(fields []string) ([]string, error) {
+	return append(fields, "", ""), nil
+}
+
+// addAccountStatus upgrades user records to version 9 which adds the status
+// and expiry of the account. Older accounts are active and never expire.
+func addAccountStatus(fields []string) ([]string, error) {
+	return append(fields, Active.String(), ""), nil
+}
+
+// addFPActions upgrades file permission records to version 3 which adds the
+// granted actions. Older file permissions granted full access, they grant
+// AnyAction.
+func addFPActions(fields []string) ([]string, error) {
+	return append(fields, AnyAction), nil
+}
+
+// addRoleParents upgrades role records to version 4 which adds the parent
+// roles. Older roles have no parents.
+func addRoleParents(fields []string) ([]string, error) {
+	return append(fields, ""), nil
+}
+
+// addRolesAndGroups upgrades user records to version 10 which adds the
+// additional roles of the user and the groups they belong to.
+func addRolesAndGroups(fields []string) ([]string, error) {
+	return append(fields, "", ""), nil
+}
+
+// addFPGroup upgrades file permission records to version 4 which adds the
+// group a file permission is granted to.
+func addFPGroup(fields []string) ([]string, error) {
+	return append(fields, ""), nil
+}
+
+// addFPDeny upgrades file permission records to version 5 which adds whether
+// a file permission denies its actions. Older file permissions grant them.
+func addFPDeny(fields []string) ([]string, error) {
+	return append(fields, "false"), nil
+}
@@ -0,0 +1,64 @@
+package user
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestMigrateLegacyConfFiles(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := "legacy-role,legacy\nold-role,old,5,put\n"
+	if err := ioutil.WriteFile(s.roleConf().name, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyRole, _ := d.Role("legacy-role")
+	oldRole, _ := d.Role("old-role")
+	if legacyRole.Name != "legacy" || oldRole.Name != "old" {
+		t.Errorf("legacy roles not read: %v", d.ListRoles())
+	}
+
+	data, err := ioutil.ReadFile(s.roleConf().name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "#userd,role,4\nlegacy-role,legacy,false,,0,put\nold-role,old,false,,5,put\n"
+	if string(data) != expected {
+		t.Errorf("expected migrated role.conf\n%s\ngot\n%s", expected, data)
+	}
+}
+
+func TestReadRejectsInvalidRecords(t *testing.T) {
+	for name, conf := range map[string]string{
+		"missing fields": "#userd,role,2\nrole-id,name,1,put\nrole-id\n",
+		"newer schema":   "#userd,role,99\nrole-id,name,1,put\n",
+		"wrong kind":     "#userd,user,2\nrole-id,name,1,put\n",
+		"bad operation":  "#userd,role,2\nrole-id,name,1,upsert\n",
+	} {
+		dir := t.TempDir()
+		s, err := newFileStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(s.roleConf().name, []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err = Open("file://" + dir)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+			continue
+		}
+		if !strings.Contains(err.Error(), s.roleConf().name) {
+			t.Errorf("%s: error should name the conf file: %v", name, err)
+		}
+	}
+}
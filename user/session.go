@@ -0,0 +1,225 @@
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/openspock/log"
+)
+
+// errInvalidToken is returned for tokens which are malformed, forged, expired
+// or revoked. The cause is only logged, clients learn nothing about it.
+var errInvalidToken = newError(ErrBadCredentials, "token is invalid or has expired")
+
+// tokenHeader is the JOSE header of every token, tokens are JWTs signed with
+// HMAC-SHA256.
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Session is issued to a user who authenticated and lets them present a
+// token instead of their credentials until it expires or is revoked.
+//
+// Sessions are stored in session.conf
+type Session struct {
+	SessionID string
+	Email     string
+	// Source is where the user authenticated from, for e.g. the address of a
+	// client of the tls server.
+	Source  string
+	Issued  time.Time
+	Expires time.Time
+	// secret signs the token of the session. Every session has its own
+	// secret, revoking a session deletes it along with the secret.
+	secret string
+}
+
+// tokenClaims are the claims of a token.
+type tokenClaims struct {
+	ID        string `json:"jti"`
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// token returns the signed token of s.
+func (s Session) token() (string, error) {
+	claims, err := json.Marshal(tokenClaims{s.SessionID, s.Email, s.Issued.Unix(), s.Expires.Unix()})
+	if err != nil {
+		return "", err
+	}
+	payload := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + s.sign(payload), nil
+}
+
+func (s Session) sign(payload string) string {
+	mac := hmac.New(sha256.New, []byte(s.secret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseToken returns the claims of a token without verifying it.
+func parseToken(token string) (tokenClaims, string, string, error) {
+	var claims tokenClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return claims, "", "", errors.New("malformed token")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, "", "", err
+	}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return claims, "", "", err
+	}
+	return claims, parts[0] + "." + parts[1], parts[2], nil
+}
+
+// CreateSession authenticates a user's credentials sent from source, see
+// AuthenticateFrom, and returns the signed token of a new session. The token
+// expires after session.ttl in the settings of the location, 1h by default.
+func (d *Directory) CreateSession(source, email, password, totp string) (string, error) {
+	log.Info("CreateSession", log.AppMsg, map[string]interface{}{"email": email, "source": source})
+
+	if err := d.AuthenticateFrom(source, email, password, totp); err != nil {
+		return "", err
+	}
+	t := d.snapshot()
+	ttl, err := t.settings.Duration("session.ttl", time.Hour)
+	if err != nil {
+		return "", err
+	}
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", err
+	}
+	secret, err := randomBytes(32)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	s := &Session{SessionID: id.String(), Email: email, Source: source, Issued: now, Expires: now.Add(ttl), secret: string(secret)}
+	token, err := s.token()
+	if err != nil {
+		return "", err
+	}
+
+	// expired sessions of the user are dropped along the way
+	mutations := []Mutation{{Session: s}}
+	for _, expired := range t.sessionsOf(email) {
+		if !now.Before(expired.Session.Expires) {
+			mutations = append(mutations, expired)
+		}
+	}
+	if err := d.config.Apply(mutations...); err != nil {
+		return "", err
+	}
+	if err := d.Reload(); err != nil {
+		return "", err
+	}
+
+	log.Info("CreateSession", log.AppMsg, map[string]interface{}{"email": email, "source": source, "session_id": s.SessionID, "result": "success", "message": "session created for " + email})
+	return token, nil
+}
+
+// Introspect verifies a token and returns its session. Tokens of sessions
+// which expired, were revoked or whose user was deleted, disabled or expired
+// are rejected.
+func (d *Directory) Introspect(token string) (Session, error) {
+	claims, payload, signature, err := parseToken(token)
+	if err != nil {
+		return Session{}, d.rejectToken(claims, err)
+	}
+	t := d.snapshot()
+	s, ok := t.sessions[claims.ID]
+	if !ok {
+		return Session{}, d.rejectToken(claims, errors.New("session does not exist"))
+	}
+	if subtle.ConstantTimeCompare([]byte(s.sign(payload)), []byte(signature)) != 1 {
+		return Session{}, d.rejectToken(claims, errors.New("signature does not match"))
+	}
+	if claims.Subject != s.Email {
+		return Session{}, d.rejectToken(claims, errors.New("subject does not match"))
+	}
+	if !time.Now().Before(s.Expires) {
+		return Session{}, d.rejectToken(claims, errors.New("session expired"))
+	}
+	u, ok := t.users[s.Email]
+	if !ok {
+		return Session{}, d.rejectToken(claims, errors.New(s.Email+" does not exist"))
+	}
+	if err := u.checkStatus(time.Now()); err != nil {
+		return Session{}, d.rejectToken(claims, err)
+	}
+	return s, nil
+}
+
+func (d *Directory) rejectToken(claims tokenClaims, err error) error {
+	log.Info("Introspect", log.AppMsg, map[string]interface{}{"session_id": claims.ID, "email": claims.Subject, "result": "failure", "message": err.Error()})
+	return errInvalidToken
+}
+
+// AuthorizeToken authorizes an action on a resource for the user of a token.
+func (d *Directory) AuthorizeToken(token, resource, action string) error {
+	log.Info("AuthorizeToken", log.AppMsg, map[string]interface{}{"resource": resource, "action": action})
+
+	s, err := d.Introspect(token)
+	if err != nil {
+		return err
+	}
+	return d.authorize(s.Email, resource, action)
+}
+
+// ListSessions lists the sessions of a user, or of all users if email is
+// empty, which haven't expired yet. Sessions are sorted by the time they were
+// issued.
+func (d *Directory) ListSessions(email string) []Session {
+	now := time.Now()
+	var sessions []Session
+	for _, s := range d.snapshot().sessions {
+		if (email == "" || s.Email == email) && now.Before(s.Expires) {
+			sessions = append(sessions, s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Issued.Before(sessions[j].Issued)
+	})
+	return sessions
+}
+
+// RevokeSession revokes a session, its token is rejected from then on.
+func (d *Directory) RevokeSession(sessionID string) error {
+	log.Info("RevokeSession", log.AppMsg, map[string]interface{}{"session_id": sessionID})
+
+	s, ok := d.snapshot().sessions[sessionID]
+	if !ok {
+		return newError(ErrNotFound, sessionID+" session does not exist")
+	}
+	if err := d.config.Apply(Mutation{Session: &s, Delete: true}); err != nil {
+		return err
+	}
+	if err := d.Reload(); err != nil {
+		return err
+	}
+
+	log.Info("RevokeSession", log.AppMsg, map[string]interface{}{"session_id": sessionID, "result": "success", "message": "session of " + s.Email + " has been revoked"})
+	return nil
+}
+
+// sessionsOf returns mutations which revoke all sessions of a user.
+func (t *tables) sessionsOf(email string) []Mutation {
+	var mutations []Mutation
+	for _, s := range t.sessions {
+		if s.Email == email {
+			s := s
+			mutations = append(mutations, Mutation{Session: &s, Delete: true})
+		}
+	}
+	return mutations
+}
@@ -0,0 +1,103 @@
+package user
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessions(t *testing.T) {
+	d, dir := openWithSettings(t, "")
+	if err := d.Initialize("session@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := d.User("session@openspock.org")
+	r, _ := d.Role(u.RoleID)
+	if _, err := d.CreateFP("/data/session", &u, &r, []string{ActionRead}, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.CreateSession("10.0.0.1", "session@openspock.org", "wrong", ""); err == nil {
+		t.Fatal("wrong password should not create a session")
+	}
+	token, err := d.CreateSession("10.0.0.1", "session@openspock.org", "password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := d.Introspect(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Email != "session@openspock.org" || s.Source != "10.0.0.1" {
+		t.Errorf("unexpected session %+v", s)
+	}
+	if err := d.AuthorizeToken(token, "/data/session", ActionRead); err != nil {
+		t.Error(err)
+	}
+	if err := d.AuthorizeToken(token, "/data/other", ActionRead); err == nil {
+		t.Error("token should not authorize resources the user has no permission for")
+	}
+
+	// tokens are verified against the session read from the location
+	reopened, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.Introspect(token); err != nil {
+		t.Errorf("token should survive a restart: %v", err)
+	}
+	parts := strings.Split(token, ".")
+	forged := parts[0] + "." + parts[1] + "." + strings.Repeat("A", len(parts[2]))
+	if _, err := reopened.Introspect(forged); err != errInvalidToken {
+		t.Errorf("expected a forged token to be rejected, got %v", err)
+	}
+
+	other, err := reopened.CreateSession("10.0.0.2", "session@openspock.org", "password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessions := reopened.ListSessions("session@openspock.org"); len(sessions) != 2 || sessions[0].SessionID != s.SessionID {
+		t.Errorf("expected 2 sessions in the order they were issued, got %+v", sessions)
+	}
+	if err := reopened.RevokeSession(s.SessionID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.Introspect(token); err != errInvalidToken {
+		t.Errorf("expected a revoked token to be rejected, got %v", err)
+	}
+	if _, err := reopened.Introspect(other); err != nil {
+		t.Errorf("other sessions should not be revoked: %v", err)
+	}
+
+	if err := reopened.ChangePassword("session@openspock.org", "password", "", "password2", "password2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.Introspect(other); err != errInvalidToken {
+		t.Errorf("expected changing the password to revoke all sessions, got %v", err)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	d, _ := openWithSettings(t, "session.ttl,100ms\n")
+	if err := d.Initialize("expiry@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	token, err := d.CreateSession("", "expiry@openspock.org", "password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := d.Introspect(token); err != errInvalidToken {
+		t.Errorf("expected an expired token to be rejected, got %v", err)
+	}
+	if sessions := d.ListSessions(""); len(sessions) != 0 {
+		t.Errorf("expired sessions should not be listed, got %+v", sessions)
+	}
+
+	if _, err := d.CreateSession("", "expiry@openspock.org", "password", ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.snapshot().sessions) != 1 {
+		t.Errorf("expired sessions should be dropped, got %d sessions", len(d.snapshot().sessions))
+	}
+}
@@ -0,0 +1,110 @@
+package user
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Settings holds the settings of a location. They are kept in userd.conf in
+// the location, one key and value per row:
+//
+//	# password policy
+//	password.min_length,12
+//	password.require_digit,true
+//
+// Rows starting with # are comments. Settings which are not set take their
+// default value.
+type Settings map[string]string
+
+// parseSettings parses the rows of a settings file from in. name is used in
+// error messages.
+func parseSettings(name string, in io.Reader) (Settings, error) {
+	s := make(Settings)
+	r := csv.NewReader(in)
+	r.Comment = '#'
+	r.FieldsPerRecord = 2
+	r.TrimLeadingSpace = true
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		line, _ := r.FieldPos(0)
+		key := strings.TrimSpace(record[0])
+		if _, ok := s[key]; ok {
+			return nil, fmt.Errorf("%s:%d: %s is set more than once", name, line, key)
+		}
+		s[key] = strings.TrimSpace(record[1])
+	}
+	return s, nil
+}
+
+// records returns the rows of a settings file holding s, sorted by key.
+func (s Settings) records() [][]string {
+	keys := make([]string, 0, len(s))
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	records := make([][]string, 0, len(keys))
+	for _, k := range keys {
+		records = append(records, []string{k, s[k]})
+	}
+	return records
+}
+
+// Int returns the integer value of key or def if it is not set.
+func (s Settings) Int(key string, def int) (int, error) {
+	v, ok := s[key]
+	if !ok {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("%s must be a number of 0 or more, got %q", key, v)
+	}
+	return i, nil
+}
+
+// Bool returns the boolean value of key or def if it is not set.
+func (s Settings) Bool(key string, def bool) (bool, error) {
+	v, ok := s[key]
+	if !ok {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false, got %q", key, v)
+	}
+	return b, nil
+}
+
+// Duration returns the duration value of key, for e.g. 15m, or def if it is
+// not set.
+func (s Settings) Duration(key string, def time.Duration) (time.Duration, error) {
+	v, ok := s[key]
+	if !ok {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%s must be a duration such as 30s or 15m, got %q", key, v)
+	}
+	return d, nil
+}
+
+// String returns the value of key or def if it is not set.
+func (s Settings) String(key, def string) string {
+	if v, ok := s[key]; ok {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,117 @@
+package user
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/openspock/log"
+)
+
+var (
+	// errAccountDisabled is returned when a disabled user authenticates.
+	errAccountDisabled = newError(ErrAccountRefused, "account is disabled")
+	// errAccountExpired is returned when a user authenticates after their
+	// account expired.
+	errAccountExpired = newError(ErrAccountRefused, "account has expired")
+)
+
+// Status is the state of an account.
+type Status int
+
+const (
+	// Active accounts can authenticate.
+	Active Status = iota
+	// Disabled accounts are refused until an admin enables them again.
+	Disabled
+	// Expired accounts are refused since their expiry passed.
+	Expired
+)
+
+func (s Status) String() string {
+	return [...]string{"active", "disabled", "expired"}[s]
+}
+
+// parseStatus parses a stored status. Only active and disabled are stored,
+// expired is derived from the expiry of a user.
+func parseStatus(value string) (Status, error) {
+	switch value {
+	case Active.String():
+		return Active, nil
+	case Disabled.String():
+		return Disabled, nil
+	}
+	return Active, fmt.Errorf("invalid status %q", value)
+}
+
+// StatusAt returns the status of a user at t.
+func (u User) StatusAt(t time.Time) Status {
+	if u.Status == Disabled {
+		return Disabled
+	}
+	if !u.Expires.IsZero() && !t.Before(u.Expires) {
+		return Expired
+	}
+	return Active
+}
+
+// checkStatus returns the error an account is refused with at now, if any.
+func (u User) checkStatus(now time.Time) error {
+	switch u.StatusAt(now) {
+	case Disabled:
+		return errAccountDisabled
+	case Expired:
+		return errAccountExpired
+	}
+	return nil
+}
+
+// DisableUser disables a user until EnableUser is called.
+func (d *Directory) DisableUser(email string) error {
+	log.Info("DisableUser", log.AppMsg, map[string]interface{}{"email": email})
+
+	if err := d.updateUser(email, func(u *User) error {
+		u.Status = Disabled
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	log.Info("DisableUser", log.AppMsg, map[string]interface{}{"email": email, "result": "success", "message": email + " has been disabled"})
+	return nil
+}
+
+// EnableUser enables a disabled or expired user and removes their expiry.
+func (d *Directory) EnableUser(email string) error {
+	log.Info("EnableUser", log.AppMsg, map[string]interface{}{"email": email})
+
+	if err := d.updateUser(email, func(u *User) error {
+		u.Status = Active
+		u.Expires = time.Time{}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	log.Info("EnableUser", log.AppMsg, map[string]interface{}{"email": email, "result": "success", "message": email + " has been enabled"})
+	return nil
+}
+
+// ExpireUser sets the expiration date of the user to now.
+func (d *Directory) ExpireUser(email string) error {
+	return d.SetUserExpiry(email, time.Now())
+}
+
+// SetUserExpiry sets when a user expires. A zero expires removes the expiry.
+func (d *Directory) SetUserExpiry(email string, expires time.Time) error {
+	log.Info("ExpireUser", log.AppMsg, map[string]interface{}{"email": email, "expires": expires.Format(time.RFC3339)})
+
+	if err := d.updateUser(email, func(u *User) error {
+		u.Expires = expires
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	log.Info("ExpireUser", log.AppMsg, map[string]interface{}{"email": email, "expires": expires.Format(time.RFC3339), "result": "success", "message": "expiry of " + email + " has been set"})
+	return nil
+}
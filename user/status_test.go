@@ -0,0 +1,61 @@
+package user
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAccountStatus(t *testing.T) {
+	d, dir := openWithSettings(t, "")
+	if err := d.Initialize("status@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	token, err := d.CreateSession("", "status@openspock.org", "password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.DisableUser("status@openspock.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Authenticate("status@openspock.org", "password", ""); err != errAccountDisabled {
+		t.Errorf("expected a disabled account to be refused, got %v", err)
+	}
+	if err := d.Authenticate("status@openspock.org", "wrong", ""); err == nil || err == errAccountDisabled {
+		t.Errorf("the status should only be revealed to the owner of the account, got %v", err)
+	}
+	if _, err := d.Introspect(token); err != errInvalidToken {
+		t.Errorf("expected the token of a disabled account to be rejected, got %v", err)
+	}
+
+	reopened, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := reopened.User("status@openspock.org"); u.StatusAt(time.Now()) != Disabled {
+		t.Errorf("expected the account to stay disabled, got %s", u.StatusAt(time.Now()))
+	}
+	if err := reopened.EnableUser("status@openspock.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Authenticate("status@openspock.org", "password", ""); err != nil {
+		t.Errorf("enabled account should authenticate: %v", err)
+	}
+
+	if err := reopened.ExpireUser("status@openspock.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Authenticate("status@openspock.org", "password", ""); err != errAccountExpired {
+		t.Errorf("expected an expired account to be refused, got %v", err)
+	}
+	if err := reopened.SetUserExpiry("status@openspock.org", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := reopened.User("status@openspock.org")
+	if s := u.StatusAt(time.Now()); s != Active {
+		t.Errorf("expected the account to be active until it expires, got %s", s)
+	}
+	if s := u.StatusAt(time.Now().Add(2 * time.Hour)); s != Expired {
+		t.Errorf("expected the account to expire, got %s", s)
+	}
+}
@@ -0,0 +1,390 @@
+package user
+
+import (
+	"strconv"
+	"sync"
+)
+
+// Store persists users, roles, file permissions, sessions, API keys and
+// certificate mappings for a userd location.
+//
+// Records are keyed - users by Email, roles by RoleID, file permissions by
+// File, UserID, RoleID, Group and Deny, sessions by SessionID, API keys by
+// KeyID and certificate mappings by Identity. Writing a record replaces the
+// current record with the same key and deleting it removes the record, read
+// operations only return the current state. FilePermissions only carry the RoleID of their
+// role, the Configuration resolves the rest once all roles have been read.
+type Store interface {
+	ReadUsers() ([]User, error)
+	ReadRoles() ([]Role, error)
+	ReadFPs() ([]FilePermission, error)
+	ReadSessions() ([]Session, error)
+	ReadAPIKeys() ([]APIKey, error)
+	ReadCertMappings() ([]CertMapping, error)
+	// ReadSettings reads the settings of the location.
+	ReadSettings() (Settings, error)
+	// WriteSettings replaces the settings of the location.
+	WriteSettings(settings Settings) error
+	// Apply commits mutations all or nothing.
+	Apply(mutations []Mutation) error
+	// Update reads the current user with email, lets update change it and
+	// commits the user along with the mutations update returns, all or
+	// nothing. No other write to the location happens in between. If update
+	// fails, nothing is committed and its error is returned. update must not
+	// call into the Store.
+	Update(email string, update func(*User) ([]Mutation, error)) error
+	// UpdateRole is Update for the role with roleID.
+	UpdateRole(roleID string, update func(*Role) ([]Mutation, error)) error
+	// UpdateAPIKey is Update for the API key with keyID.
+	UpdateAPIKey(keyID string, update func(*APIKey) ([]Mutation, error)) error
+	// Compact discards superseded and deleted records.
+	Compact() error
+	// Migrate upgrades records stored in an older layout.
+	Migrate() error
+	// Recover completes or rolls back writes that were interrupted, for e.g.
+	// by a crash.
+	Recover() error
+	// RLock keeps writers out until the returned unlock function is called,
+	// so that consecutive reads see the same state.
+	RLock() (unlock func() error, err error)
+}
+
+// KeyRotator is implemented by stores which encrypt records at rest.
+type KeyRotator interface {
+	// RotateKey re-encrypts all records with a newly generated key.
+	RotateKey() error
+}
+
+// Mutation writes or deletes a single record. Exactly one of User, Role, FP,
+// Session, APIKey and CertMapping is set.
+type Mutation struct {
+	User        *User
+	Role        *Role
+	FP          *FilePermission
+	Session     *Session
+	APIKey      *APIKey
+	CertMapping *CertMapping
+	Delete      bool
+}
+
+func userKey(u *User) string {
+	return u.Email
+}
+
+func roleKey(r *Role) string {
+	return r.RoleID
+}
+
+func fpKey(fp *FilePermission) string {
+	return fp.File + "|" + fp.UserID + "|" + fp.Role.RoleID + "|" + fp.Group + "|" + strconv.FormatBool(fp.Deny)
+}
+
+func sessionKey(s *Session) string {
+	return s.SessionID
+}
+
+func apiKeyKey(k *APIKey) string {
+	return k.KeyID
+}
+
+func certMappingKey(m *CertMapping) string {
+	return m.Identity
+}
+
+// memoryStore keeps records in process memory for mem:// locations. All
+// configurations built for the same location share one memoryStore.
+type memoryStore struct {
+	// snapshot is held by readers for consecutive reads, mu guards
+	// individual reads
+	snapshot sync.RWMutex
+	mu       sync.RWMutex
+	users    []User
+	roles    []Role
+	fps      []FilePermission
+	sessions []Session
+	apiKeys  []APIKey
+	mappings []CertMapping
+	settings Settings
+}
+
+var memoryStores = struct {
+	sync.Mutex
+	m map[string]*memoryStore
+}{m: make(map[string]*memoryStore)}
+
+func newMemoryStore(location string) *memoryStore {
+	memoryStores.Lock()
+	defer memoryStores.Unlock()
+	s, ok := memoryStores.m[location]
+	if !ok {
+		s = &memoryStore{}
+		memoryStores.m[location] = s
+	}
+	return s
+}
+
+func (s *memoryStore) ReadUsers() ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]User(nil), s.users...), nil
+}
+
+func (s *memoryStore) ReadRoles() ([]Role, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Role(nil), s.roles...), nil
+}
+
+func (s *memoryStore) ReadFPs() ([]FilePermission, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]FilePermission(nil), s.fps...), nil
+}
+
+func (s *memoryStore) ReadSessions() ([]Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Session(nil), s.sessions...), nil
+}
+
+func (s *memoryStore) ReadAPIKeys() ([]APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]APIKey(nil), s.apiKeys...), nil
+}
+
+func (s *memoryStore) ReadCertMappings() ([]CertMapping, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]CertMapping(nil), s.mappings...), nil
+}
+
+func (s *memoryStore) ReadSettings() (Settings, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	settings := make(Settings, len(s.settings))
+	for k, v := range s.settings {
+		settings[k] = v
+	}
+	return settings, nil
+}
+
+func (s *memoryStore) WriteSettings(settings Settings) error {
+	s.snapshot.Lock()
+	defer s.snapshot.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settings = make(Settings, len(settings))
+	for k, v := range settings {
+		s.settings[k] = v
+	}
+	return nil
+}
+
+func (s *memoryStore) Apply(mutations []Mutation) error {
+	s.snapshot.Lock()
+	defer s.snapshot.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apply(mutations)
+	return nil
+}
+
+func (s *memoryStore) Update(email string, update func(*User) ([]Mutation, error)) error {
+	s.snapshot.Lock()
+	defer s.snapshot.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.Email != email {
+			continue
+		}
+		mutations, err := update(&u)
+		if err != nil {
+			return err
+		}
+		s.apply(append(mutations, Mutation{User: &u}))
+		return nil
+	}
+	return newError(ErrNotFound, email+" does not exist")
+}
+
+func (s *memoryStore) UpdateRole(roleID string, update func(*Role) ([]Mutation, error)) error {
+	s.snapshot.Lock()
+	defer s.snapshot.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.roles {
+		if r.RoleID != roleID {
+			continue
+		}
+		mutations, err := update(&r)
+		if err != nil {
+			return err
+		}
+		s.apply(append(mutations, Mutation{Role: &r}))
+		return nil
+	}
+	return newError(ErrNotFound, roleID+" does not exist")
+}
+
+func (s *memoryStore) UpdateAPIKey(keyID string, update func(*APIKey) ([]Mutation, error)) error {
+	s.snapshot.Lock()
+	defer s.snapshot.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range s.apiKeys {
+		if k.KeyID != keyID {
+			continue
+		}
+		mutations, err := update(&k)
+		if err != nil {
+			return err
+		}
+		s.apply(append(mutations, Mutation{APIKey: &k}))
+		return nil
+	}
+	return newError(ErrNotFound, keyID+" does not exist")
+}
+
+// apply commits mutations. Callers hold both locks.
+func (s *memoryStore) apply(mutations []Mutation) {
+	for _, m := range mutations {
+		switch {
+		case m.User != nil:
+			s.users = applyUser(s.users, *m.User, m.Delete)
+		case m.Role != nil:
+			s.roles = applyRole(s.roles, *m.Role, m.Delete)
+		case m.FP != nil:
+			fp := *m.FP
+			fp.Role = Role{RoleID: fp.Role.RoleID}
+			s.fps = applyFP(s.fps, fp, m.Delete)
+		case m.Session != nil:
+			s.sessions = applySession(s.sessions, *m.Session, m.Delete)
+		case m.APIKey != nil:
+			s.apiKeys = applyAPIKey(s.apiKeys, *m.APIKey, m.Delete)
+		case m.CertMapping != nil:
+			s.mappings = applyCertMapping(s.mappings, *m.CertMapping, m.Delete)
+		}
+	}
+}
+
+// Compact is a no-op, a memoryStore only ever holds current records.
+func (s *memoryStore) Compact() error {
+	return nil
+}
+
+func (s *memoryStore) RLock() (func() error, error) {
+	s.snapshot.RLock()
+	return func() error {
+		s.snapshot.RUnlock()
+		return nil
+	}, nil
+}
+
+// Migrate is a no-op, a memoryStore always holds records in the current
+// layout.
+func (s *memoryStore) Migrate() error {
+	return nil
+}
+
+// Recover is a no-op, memoryStore writes can't be interrupted.
+func (s *memoryStore) Recover() error {
+	return nil
+}
+
+func applyUser(users []User, u User, delete bool) []User {
+	for i := range users {
+		if userKey(&users[i]) == userKey(&u) {
+			if delete {
+				return append(users[:i], users[i+1:]...)
+			}
+			users[i] = u
+			return users
+		}
+	}
+	if delete {
+		return users
+	}
+	return append(users, u)
+}
+
+func applyRole(roles []Role, r Role, delete bool) []Role {
+	for i := range roles {
+		if roleKey(&roles[i]) == roleKey(&r) {
+			if delete {
+				return append(roles[:i], roles[i+1:]...)
+			}
+			roles[i] = r
+			return roles
+		}
+	}
+	if delete {
+		return roles
+	}
+	return append(roles, r)
+}
+
+func applyFP(fps []FilePermission, fp FilePermission, delete bool) []FilePermission {
+	for i := range fps {
+		if fpKey(&fps[i]) == fpKey(&fp) {
+			if delete {
+				return append(fps[:i], fps[i+1:]...)
+			}
+			fps[i] = fp
+			return fps
+		}
+	}
+	if delete {
+		return fps
+	}
+	return append(fps, fp)
+}
+
+func applySession(sessions []Session, session Session, delete bool) []Session {
+	for i := range sessions {
+		if sessionKey(&sessions[i]) == sessionKey(&session) {
+			if delete {
+				return append(sessions[:i], sessions[i+1:]...)
+			}
+			sessions[i] = session
+			return sessions
+		}
+	}
+	if delete {
+		return sessions
+	}
+	return append(sessions, session)
+}
+
+func applyAPIKey(keys []APIKey, k APIKey, delete bool) []APIKey {
+	for i := range keys {
+		if apiKeyKey(&keys[i]) == apiKeyKey(&k) {
+			if delete {
+				return append(keys[:i], keys[i+1:]...)
+			}
+			keys[i] = k
+			return keys
+		}
+	}
+	if delete {
+		return keys
+	}
+	return append(keys, k)
+}
+
+func applyCertMapping(mappings []CertMapping, m CertMapping, delete bool) []CertMapping {
+	for i := range mappings {
+		if certMappingKey(&mappings[i]) == certMappingKey(&m) {
+			if delete {
+				return append(mappings[:i], mappings[i+1:]...)
+			}
+			mappings[i] = m
+			return mappings
+		}
+	}
+	if delete {
+		return mappings
+	}
+	return append(mappings, m)
+}
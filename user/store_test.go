@@ -0,0 +1,246 @@
+package user
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreIsSharedPerLocation(t *testing.T) {
+	d, err := Open("mem://shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	role, err := d.CreateRole("store-shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewConfig("mem://shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roles, err := c.Store.ReadRoles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 1 || roles[0].RoleID != role.RoleID {
+		t.Errorf("expected role %s in store, got %v", role.RoleID, roles)
+	}
+}
+
+func TestMigrateTo(t *testing.T) {
+	useFastHasher(t)
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "banned.txt"), []byte("letmein1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "userd.conf"), []byte("password.banned_file,banned.txt\nsession.ttl,2h\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	role, err := d.CreateRole("store-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateUser("migrate@openspock.org", "password", "migrated user", role.RoleID); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := d.User("migrate@openspock.org")
+	if _, err := d.CreateFP("/data/migrate", &u, &Role{}, []string{ActionRead}, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	session, err := d.CreateSession("", "migrate@openspock.org", "password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateServiceAccount("migrate-service", "migrated service", role.RoleID); err != nil {
+		t.Fatal(err)
+	}
+	key, _, err := d.IssueAPIKey("migrate-service", "migrated key", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.MapCertificate("email:migrate@openspock.org", "migrate@openspock.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	// file to memory and back to another file location
+	if err := d.MigrateTo("mem://migrate-round-trip"); err != nil {
+		t.Fatal(err)
+	}
+	mem, err := Open("mem://migrate-round-trip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := "file://" + t.TempDir()
+	if err := mem.MigrateTo(dst); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewConfig(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := c.Store.ReadUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Errorf("users not migrated: %v", users)
+	}
+	fps, err := c.Store.ReadFPs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fps) != 1 || fps[0].File != "/data/migrate" || fps[0].UserID != u.UserID {
+		t.Errorf("file permission not migrated: %v", fps)
+	}
+	settings, err := c.Store.ReadSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings["session.ttl"] != "2h" || settings["password.banned_file"] != filepath.Join(dir, "banned.txt") {
+		t.Errorf("settings not migrated: %v", settings)
+	}
+
+	migrated, err := Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrated.Authenticate("migrate@openspock.org", "password", ""); err != nil {
+		t.Error(err)
+	}
+	if _, err := migrated.Introspect(session); err != nil {
+		t.Errorf("session not migrated: %v", err)
+	}
+	if _, err := migrated.AuthenticateAPIKey("", key); err != nil {
+		t.Errorf("API key not migrated: %v", err)
+	}
+	if _, ok := migrated.snapshot().certMappings["email:migrate@openspock.org"]; !ok {
+		t.Error("certificate mapping not migrated")
+	}
+	var policyErr *PasswordPolicyError
+	if err := migrated.CreateUser("banned@openspock.org", "letmein1", "", role.RoleID); !errors.As(err, &policyErr) {
+		t.Errorf("expected the banned passwords to be migrated, got %v", err)
+	}
+
+	// a file location takes the banned passwords file along
+	copied := t.TempDir()
+	if err := d.MigrateTo("file://" + copied); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(copied, "banned.txt")); err != nil {
+		t.Errorf("expected the banned passwords file to be copied: %v", err)
+	}
+}
+
+func TestMigrateToReadsUnderTheLock(t *testing.T) {
+	defer func(timeout time.Duration) { LockTimeout = timeout }(LockTimeout)
+	LockTimeout = 50 * time.Millisecond
+
+	d, err := Open("file://" + t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CreateRole("store-migrate-lock"); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := d.config.Store.(*fileStore).lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.MigrateTo("mem://migrate-lock"); err == nil {
+		t.Error("MigrateTo should wait for a write in progress")
+	}
+	lock.Unlock()
+	if err := d.MigrateTo("mem://migrate-lock"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFileStoreLastWriteWins(t *testing.T) {
+	d, err := Open("file://" + t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	role, err := d.CreateRole("store-lww")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateUser("lww@openspock.org", "password", "lww user", role.RoleID); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ChangePassword("lww@openspock.org", "password", "", "password2", "password2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Authenticate("lww@openspock.org", "password2", ""); err != nil {
+		t.Error(err)
+	}
+	if err := d.Authenticate("lww@openspock.org", "password", ""); err == nil {
+		t.Error("old password should not authenticate")
+	}
+	if d.UserCount() != 1 {
+		t.Errorf("directory should have exactly 1 user, got %d", d.UserCount())
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	d, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	role, err := d.CreateRole("store-compact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, email := range []string{"keep@openspock.org", "gone@openspock.org"} {
+		if err := d.CreateUser(email, "password", "compact user", role.RoleID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.ChangePassword("keep@openspock.org", "password", "", "password2", "password2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeleteUser("gone@openspock.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := readRows(s.userConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 {
+		t.Fatalf("expected 4 rows before compaction, got %d", len(rows))
+	}
+
+	if err := d.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	rows, err = readRows(s.userConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].fields[4] != "keep@openspock.org" {
+		t.Fatalf("expected only keep@openspock.org after compaction, got %v", rows)
+	}
+	if err := d.Authenticate("keep@openspock.org", "password2", ""); err != nil {
+		t.Error(err)
+	}
+	if err := d.Authenticate("gone@openspock.org", "password", ""); err == nil {
+		t.Error("deleted user should not authenticate")
+	}
+	if _, ok := d.User("gone@openspock.org"); ok {
+		t.Error("deleted user should have been removed from the directory")
+	}
+}
@@ -0,0 +1,276 @@
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/openspock/log"
+)
+
+// RFC 6238 parameters of the TOTP secrets userd enrolls. They are the
+// defaults of authenticator apps.
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// totpSkew is the number of periods a code may be early or late to make
+	// up for clock drift.
+	totpSkew = 1
+	// recoveryCodeCount is the number of recovery codes handed out on
+	// enrollment.
+	recoveryCodeCount = 10
+)
+
+var (
+	// errSecondFactorRequired is returned if a user who has to use a second
+	// factor has not enrolled one yet.
+	errSecondFactorRequired = newError(ErrBadCredentials, "a second factor is required, please enroll a TOTP secret")
+	// errSecondFactor is returned for a missing or wrong TOTP or recovery
+	// code.
+	errSecondFactor = newError(ErrBadCredentials, "totp code does not match")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpState is the second factor of a user.
+type totpState struct {
+	// secret is the base32 encoded TOTP secret, empty if the user has not
+	// enrolled one.
+	secret string
+	// step is the last time step a code was accepted for, codes can't be
+	// used twice.
+	step int64
+	// recoveryCodes holds the hashes of unused recovery codes.
+	recoveryCodes []string
+}
+
+func (s totpState) enrolled() bool {
+	return s.secret != ""
+}
+
+// newTOTPSecret generates a random 160 bit secret, as recommended by RFC 4226.
+func newTOTPSecret() (string, error) {
+	secret, err := randomBytes(20)
+	if err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// totpCode returns the code of a secret for a time step, see RFC 4226.
+func totpCode(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000)
+}
+
+// verifyTOTP checks a code against the secret at now. Codes of time steps up
+// to last are rejected. It returns the time step of the code.
+func verifyTOTP(secret, code string, now time.Time, last int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= last {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI returns the otpauth:// URI of a secret, which authenticator apps
+// read from a QR code.
+func totpURI(issuer, email, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(email)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// newRecoveryCodes generates single use recovery codes such as
+// abcde-fghij along with their hashes.
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b, err := randomBytes(7)
+		if err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		code = code[:5] + "-" + code[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes a recovery code. Recovery codes are random, unlike
+// passwords they don't need a slow hash.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// requiresTOTP reports if a user has to authenticate with a second factor,
+// because they or any role they hold, directly or through inheritance,
+// require one. Once enrolled, the second factor is always checked.
+func (t *tables) requiresTOTP(u User) bool {
+	if u.RequireTOTP || u.totp.enrolled() {
+		return true
+	}
+	for roleID := range t.effectiveRoles(u) {
+		if t.roles[roleID].RequireTOTP {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSecondFactor checks the TOTP or recovery code sent by a user who
+// requires a second factor. A used code or recovery code is persisted, so
+// that it can't be used again.
+func (d *Directory) checkSecondFactor(u User, code string, now time.Time) error {
+	if !u.totp.enrolled() {
+		return errSecondFactorRequired
+	}
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return errSecondFactor
+	}
+
+	if len(code) == totpDigits {
+		if d.readOnly() {
+			d.attemptsMu.Lock()
+			defer d.attemptsMu.Unlock()
+			last := u.totp.step
+			if d.steps[u.Email] > last {
+				last = d.steps[u.Email]
+			}
+			step, ok := verifyTOTP(u.totp.secret, code, now, last)
+			if !ok {
+				return errSecondFactor
+			}
+			d.steps[u.Email] = step
+			return nil
+		}
+		step, ok := verifyTOTP(u.totp.secret, code, now, u.totp.step)
+		if !ok {
+			return errSecondFactor
+		}
+		// the step is checked again under the store's lock, another process
+		// may have accepted the same code meanwhile
+		return d.updateUser(u.Email, func(u *User) error {
+			if step <= u.totp.step {
+				return errSecondFactor
+			}
+			u.totp.step = step
+			return nil
+		})
+	}
+
+	if d.readOnly() {
+		return newError(ErrInvalid, "recovery codes can't be used with a read-only location")
+	}
+	hash := hashRecoveryCode(code)
+	return d.updateUser(u.Email, func(u *User) error {
+		for i, h := range u.totp.recoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+				u.totp.recoveryCodes = append(u.totp.recoveryCodes[:i:i], u.totp.recoveryCodes[i+1:]...)
+				log.Info("RecoveryCode", log.AppMsg, map[string]interface{}{"email": u.Email, "message": fmt.Sprintf("recovery code used, %d left", len(u.totp.recoveryCodes))})
+				return nil
+			}
+		}
+		return errSecondFactor
+	})
+}
+
+// EnrollTOTP enrolls a new TOTP secret for a user and returns its otpauth://
+// URI along with new single use recovery codes. Users who already enrolled a
+// secret have to confirm with a code of their current secret or a recovery
+// code. The issuer shown by authenticator apps is set by totp.issuer in the
+// settings of the location.
+func (d *Directory) EnrollTOTP(email, password, totp string) (uri string, recoveryCodes []string, err error) {
+	log.Info("EnrollTOTP", log.AppMsg, map[string]interface{}{"email": email})
+
+	if err := d.authenticate("", email, password, totp, true); err != nil {
+		return "", nil, err
+	}
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return "", nil, err
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return "", nil, err
+	}
+	err = d.updateUser(email, func(u *User) error {
+		u.totp = totpState{secret: secret, recoveryCodes: hashes}
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	log.Info("EnrollTOTP", log.AppMsg, map[string]interface{}{"email": email, "result": "success", "message": "TOTP secret enrolled for " + email})
+	return totpURI(d.snapshot().settings.String("totp.issuer", "userd"), email, secret), codes, nil
+}
+
+// RemoveTOTP removes the TOTP secret and recovery codes of a user, for e.g.
+// after they lost their device.
+func (d *Directory) RemoveTOTP(email string) error {
+	log.Info("RemoveTOTP", log.AppMsg, map[string]interface{}{"email": email})
+
+	err := d.updateUser(email, func(u *User) error {
+		u.totp = totpState{}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info("RemoveTOTP", log.AppMsg, map[string]interface{}{"email": email, "result": "success", "message": "TOTP secret removed for " + email})
+	return nil
+}
+
+// RequireUserTOTP sets if a user has to authenticate with a second factor.
+func (d *Directory) RequireUserTOTP(email string, required bool) error {
+	log.Info("RequireUserTOTP", log.AppMsg, map[string]interface{}{"email": email, "required": required})
+
+	return d.updateUser(email, func(u *User) error {
+		u.RequireTOTP = required
+		return nil
+	})
+}
+
+// RequireRoleTOTP sets if all users of a role, and of the roles inheriting
+// from it, have to authenticate with a second factor.
+func (d *Directory) RequireRoleTOTP(roleID string, required bool) error {
+	log.Info("RequireRoleTOTP", log.AppMsg, map[string]interface{}{"role_id": roleID, "required": required})
+
+	return d.updateRole(roleID, func(r *Role) error {
+		r.RequireTOTP = required
+		return nil
+	})
+}
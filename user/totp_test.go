@@ -0,0 +1,160 @@
+package user
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// test vectors of RFC 6238, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	for unix, expected := range map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 2000000000: "279037"} {
+		if code := totpCode(secret, unix/totpPeriod); code != expected {
+			t.Errorf("code at %d = %s, expected %s", unix, code, expected)
+		}
+	}
+}
+
+// currentTOTP returns the code of the secret in an otpauth:// URI for a time
+// step relative to now.
+func currentTOTP(t *testing.T, uri string, offset int64) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := totpEncoding.DecodeString(u.Query().Get("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return totpCode(key, time.Now().Unix()/totpPeriod+offset)
+}
+
+func TestEnrollTOTP(t *testing.T) {
+	d, dir := openWithSettings(t, "totp.issuer,openspock\nthrottle.delay,0s\n")
+	if err := d.Initialize("totp@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	uri, codes, err := d.EnrollTOTP("totp@openspock.org", "password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(uri, "otpauth://totp/openspock:totp@openspock.org?") || !strings.Contains(uri, "issuer=openspock") {
+		t.Errorf("unexpected uri %s", uri)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Errorf("expected %d recovery codes, got %d", recoveryCodeCount, len(codes))
+	}
+
+	if err := d.Authenticate("totp@openspock.org", "password", ""); err != errSecondFactor {
+		t.Errorf("expected a missing code to be rejected, got %v", err)
+	}
+	if err := d.Authenticate("totp@openspock.org", "password", currentTOTP(t, uri, 5)); err != errSecondFactor {
+		t.Errorf("expected a wrong code to be rejected, got %v", err)
+	}
+	code := currentTOTP(t, uri, 0)
+	if err := d.Authenticate("totp@openspock.org", "password", code); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Authenticate("totp@openspock.org", "password", code); err != errSecondFactor {
+		t.Errorf("expected a used code to be rejected, got %v", err)
+	}
+
+	// state survives a restart
+	reopened, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Authenticate("totp@openspock.org", "password", code); err != errSecondFactor {
+		t.Errorf("expected a used code to stay rejected, got %v", err)
+	}
+	if err := reopened.Authenticate("totp@openspock.org", "password", currentTOTP(t, uri, 1)); err != nil {
+		t.Errorf("code of the next time step should be accepted: %v", err)
+	}
+	if err := reopened.Authenticate("totp@openspock.org", "password", strings.ToUpper(codes[0])); err != nil {
+		t.Errorf("recovery code should be accepted: %v", err)
+	}
+	if err := reopened.Authenticate("totp@openspock.org", "password", codes[0]); err != errSecondFactor {
+		t.Errorf("expected a used recovery code to be rejected, got %v", err)
+	}
+
+	// re-enrolling requires the second factor
+	if _, _, err := reopened.EnrollTOTP("totp@openspock.org", "password", ""); err == nil {
+		t.Error("re-enrolling without a code should fail")
+	}
+	if _, _, err := reopened.EnrollTOTP("totp@openspock.org", "password", codes[1]); err != nil {
+		t.Errorf("re-enrolling with a recovery code should succeed: %v", err)
+	}
+
+	if err := reopened.RemoveTOTP("totp@openspock.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Authenticate("totp@openspock.org", "password", ""); err != nil {
+		t.Errorf("user without a second factor should authenticate with their password: %v", err)
+	}
+}
+
+func TestRequireTOTP(t *testing.T) {
+	d, _ := openWithSettings(t, "")
+	if err := d.Initialize("required@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := d.User("required@openspock.org")
+	if err := d.RequireRoleTOTP(u.RoleID, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Authenticate("required@openspock.org", "password", ""); err != errSecondFactorRequired {
+		t.Fatalf("expected the role to require a second factor, got %v", err)
+	}
+	if u, _ := d.User("required@openspock.org"); u.attempts.failures != 0 {
+		t.Errorf("missing enrollment should not count as a failed attempt, got %d", u.attempts.failures)
+	}
+	uri, _, err := d.EnrollTOTP("required@openspock.org", "password", "")
+	if err != nil {
+		t.Fatalf("users required to use a second factor should be able to enroll: %v", err)
+	}
+	if err := d.Authenticate("required@openspock.org", "password", currentTOTP(t, uri, 0)); err != nil {
+		t.Error(err)
+	}
+
+	if err := d.RequireRoleTOTP(u.RoleID, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateUser("optional@openspock.org", "password", "optional user", u.RoleID); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Authenticate("optional@openspock.org", "password", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RequireUserTOTP("optional@openspock.org", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Authenticate("optional@openspock.org", "password", ""); err != errSecondFactorRequired {
+		t.Errorf("expected the user to require a second factor, got %v", err)
+	}
+}
+
+func TestTOTPReplayAcrossProcesses(t *testing.T) {
+	d, dir := openWithSettings(t, "throttle.delay,0s\n")
+	if err := d.Initialize("totp@openspock.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	uri, _, err := d.EnrollTOTP("totp@openspock.org", "password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a second directory stands in for another process, its snapshot
+	// doesn't know about the code the first one accepts
+	other, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := currentTOTP(t, uri, 0)
+	if err := d.Authenticate("totp@openspock.org", "password", code); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Authenticate("totp@openspock.org", "password", code); err != errSecondFactor {
+		t.Errorf("expected a code used by another process to be rejected, got %v", err)
+	}
+}
@@ -3,16 +3,11 @@
 package user
 
 import (
-	"encoding/csv"
 	"errors"
-	"io"
-	"os"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/juju/fslock"
-	"github.com/openspock/userd/config"
 )
 
 // AccessPermissions is a enumeration constant for resource access permissions.
@@ -31,13 +26,19 @@ const (
 type Role struct {
 	RoleID string
 	Name   string
+	// RequireTOTP requires all users of the role to authenticate with a
+	// second factor.
+	RequireTOTP bool
+	// Parents are the RoleIDs of the roles this role inherits from. Users of
+	// the role are granted the file permissions of all its ancestors.
+	Parents []string
 }
 
 // NewRole creates a new Role and returns it.
-func NewRole(name string) (*Role, error) {
-	for _, v := range RoleTable {
+func (d *Directory) NewRole(name string) (*Role, error) {
+	for _, v := range d.snapshot().roles {
 		if v.Name == name {
-			return nil, errors.New(name + " already exists")
+			return nil, newError(ErrExists, name+" already exists")
 		}
 	}
 	uuid, err := uuid.NewRandom()
@@ -60,21 +61,46 @@ type User struct {
 	Description string
 	Since       time.Time
 	RoleID      string
+	// Roles are the RoleIDs of the roles the user holds besides RoleID.
+	Roles []string
+	// Groups are the names of the groups the user belongs to.
+	Groups []string
+	// RequireTOTP requires the user to authenticate with a second factor.
+	RequireTOTP bool
+	// Service marks service accounts, whose Email holds their name. They
+	// authenticate with API keys instead of a password.
+	Service bool
+	// Status is either Active or Disabled, see StatusAt for the status
+	// including the expiry.
+	Status Status
+	// Expires is when the account expires, accounts with a zero Expires never
+	// do.
+	Expires time.Time
+	// history holds the hashes of previous passwords, most recent first.
+	history []string
+	// attempts counts consecutive failed authentication attempts.
+	attempts attempts
+	// totp is the second factor of the user.
+	totp totpState
+	// reset is an outstanding password reset token of the user.
+	reset resetToken
 }
 
 func (u User) String() string {
 	return u.Email
 }
 
-// NewUser creates a new user and stores it in user conf.
-func NewUser(email, description, secret, salt, hash, roleID string) (*User, error) {
-	if _, ok := RoleTable[roleID]; !ok {
-		return nil, errors.New(roleID + " does not exist")
+// NewUser creates a new user and returns it.
+func (d *Directory) NewUser(email, description, secret, salt, hash, roleID string) (*User, error) {
+	return d.snapshot().newUser(email, description, secret, salt, hash, roleID)
+}
+
+func (t *tables) newUser(email, description, secret, salt, hash, roleID string) (*User, error) {
+	if _, ok := t.roles[roleID]; !ok {
+		return nil, newError(ErrNotFound, roleID+" does not exist")
 	}
-	for k := range UserTable {
-		if email == k {
-			return nil, errors.New(email + " already exists")
-		}
+	if _, ok := t.users[email]; ok {
+		return nil, newError(ErrExists, email+" already exists")
 	}
 	uuid, err := uuid.NewRandom()
 	if err != nil {
@@ -86,7 +112,8 @@ func NewUser(email, description, secret, salt, hash, roleID string) (*User, erro
 
 // FilePermission represents permissions per file/ resource, per user.
 //
-// Either UserID or Role is mandatory
+// Either UserID, Role or Group is mandatory, except for file permissions
+// which deny actions. Those apply to everyone if all are left empty.
 //
 // A file or resource can be identified with a URL.
 // Examples -
@@ -100,11 +127,27 @@ type FilePermission struct {
 	Role       Role
 	Assignment time.Time
 	Expiration time.Time
+	// Actions are the actions granted on the resource, for e.g. read, write
+	// or custom verbs such as deploy.
+	Actions []string
+	// Group is the group the file permission is granted to, if any.
+	Group string
+	// Deny is set if the file permission denies its actions instead of
+	// granting them.
+	Deny bool
 }
 
 // NewFP creates new FilePermission
-func NewFP(file string, user User, role Role, expiration time.Time) (*FilePermission, error) {
-	return &FilePermission{File: file, UserID: user.UserID, Role: role, Assignment: time.Now(), Expiration: expiration}, nil
+func NewFP(file string, user User, role Role, actions []string, expiration time.Time) (*FilePermission, error) {
+	if len(actions) == 0 {
+		return nil, newError(ErrInvalid, "at least one action is required")
+	}
+	for _, a := range actions {
+		if err := checkAction(a); err != nil {
+			return nil, err
+		}
+	}
+	return &FilePermission{File: file, UserID: user.UserID, Role: role, Assignment: time.Now(), Expiration: expiration, Actions: actions}, nil
 }
 
 // Protocol has configuration file access protocol.
@@ -113,199 +156,124 @@ type Protocol int
 const (
 	// File is local file access protocol.
 	File Protocol = iota << 1
+	// Memory keeps configuration in process memory. It is mostly useful for
+	// tests and ephemeral setups.
+	Memory
+	// HTTP reads configuration from a remote http(s) location. It is read-only.
+	HTTP
 )
 
 // Configuration represents userd configuration.
 type Configuration struct {
 	Location           string
 	FileAccessProtocol Protocol
+	Store              Store
 }
 
 // NewConfig builds a new Configuration by taking a
-// file directory as an input. For e.g.
+// file directory as an input. Use Open to load the Directory of a
+// Configuration. For e.g.
 //
 // file:/etc/userd
+// mem://test
 // https://openspock.org/userd
 func NewConfig(file string) (*Configuration, error) {
 	p := strings.Split(file, "://")
 	if len(p) != 2 {
-		return nil, errors.New("file doesn't have protocol information")
+		return nil, newError(ErrInvalid, "file doesn't have protocol information")
 	}
-	var protocol Protocol
+	c := Configuration{Location: p[1]}
 	switch p[0] {
 	case "file":
-		protocol = File
-	default:
-		return nil, errors.New("unknown protocol")
-	}
-	c := Configuration{p[1], protocol}
-
-	if _, err := os.Stat(c.Location); os.IsNotExist(err) {
-		os.Mkdir(c.Location, os.ModeDir)
-		if err := os.Chmod(c.Location, 0755); err != nil {
-			return nil, err
+		s, err := newFileStore(c.Location)
+		if err != nil {
+			return nil, storageError(err)
+		}
+		c.FileAccessProtocol = File
+		c.Store = s
+	case "mem":
+		c.FileAccessProtocol = Memory
+		c.Store = newMemoryStore(c.Location)
+	case "http", "https":
+		s, err := newHTTPStore(file)
+		if err != nil {
+			return nil, storageError(err)
 		}
+		c.FileAccessProtocol = HTTP
+		c.Store = s
+	default:
+		return nil, newError(ErrInvalid, "unknown protocol")
 	}
 
-	c.InitRead()
 	return &c, nil
 }
 
-func (c *Configuration) userConfFileName() string {
-	return c.Location + config.GetUserConfFileName()
+// Apply commits mutations to the configured store all or nothing.
+func (c *Configuration) Apply(mutations ...Mutation) error {
+	return storageError(c.Store.Apply(mutations))
 }
 
-func (c *Configuration) roleConfFileName() string {
-	return c.Location + config.GetRoleConfFileName()
+// UpdateUser changes the current user with email in the configured store,
+// see Store.Update. Errors of update are returned as they are.
+func (c *Configuration) UpdateUser(email string, update func(*User) ([]Mutation, error)) error {
+	var failed error
+	err := c.Store.Update(email, func(u *User) ([]Mutation, error) {
+		mutations, err := update(u)
+		failed = err
+		return mutations, err
+	})
+	return updateError(err, failed)
 }
 
-func (c *Configuration) filePermissionFileName() string {
-	return c.Location + config.GetFPFileName()
+// UpdateRole changes the current role with roleID in the configured store,
+// see UpdateUser.
+func (c *Configuration) UpdateRole(roleID string, update func(*Role) ([]Mutation, error)) error {
+	var failed error
+	err := c.Store.UpdateRole(roleID, func(r *Role) ([]Mutation, error) {
+		mutations, err := update(r)
+		failed = err
+		return mutations, err
+	})
+	return updateError(err, failed)
 }
 
-// InitRead initializes userd configuration.
-//
-// 1. init user conf
-// 2. int fperm conf
-func (c *Configuration) InitRead() error {
-	err := c.read(c.userConfFileName(), parseUser, userTableInsert)
-	err = c.read(c.roleConfFileName(), parseRoles, roleTableInsert)
-	err = c.read(c.filePermissionFileName(), parseFilePermission, filePermissionTableInsert)
-	return err
+// UpdateAPIKey changes the current API key with keyID in the configured
+// store, see UpdateUser.
+func (c *Configuration) UpdateAPIKey(keyID string, update func(*APIKey) ([]Mutation, error)) error {
+	var failed error
+	err := c.Store.UpdateAPIKey(keyID, func(k *APIKey) ([]Mutation, error) {
+		mutations, err := update(k)
+		failed = err
+		return mutations, err
+	})
+	return updateError(err, failed)
 }
 
-func (c *Configuration) read(file string, handler parseRecord, insertIntoTable tableInsert) error {
-	config, err := os.Open(file)
-	if err != nil {
+// updateError returns the error of an update of a store. Errors of the
+// update function and missing records are returned as they are.
+func updateError(err, failed error) error {
+	if err != nil && (err == failed || errors.Is(err, ErrNotFound)) {
 		return err
 	}
-	defer config.Close()
-
-	r := csv.NewReader(config)
-	for {
-		record, err := r.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
-		u, key, err := handler(record)
-		if err != nil {
-			return err
-		}
-		insertIntoTable(key, u)
-	}
+	return storageError(err)
+}
 
-	return nil
+// WriteSettings replaces the settings of the configured store.
+func (c *Configuration) WriteSettings(settings Settings) error {
+	return storageError(c.Store.WriteSettings(settings))
 }
 
-// WriteUser writes a user to the user conf file.
+// WriteUser writes a user to the configured store.
 func (c *Configuration) WriteUser(u *User) error {
-	return c.write(c.userConfFileName(), []string{u.UserID, u.secret, u.Salt, u.hash, u.Email, u.Description, u.Since.Format(time.RFC3339), u.RoleID})
+	return c.Apply(Mutation{User: u})
 }
 
-// WriteRole writes a role to the role conf file.
+// WriteRole writes a role to the configured store.
 func (c *Configuration) WriteRole(r *Role) error {
-	return c.write(c.roleConfFileName(), []string{r.RoleID, r.Name})
+	return c.Apply(Mutation{Role: r})
 }
 
-// WriteFP writes a FilePermission to file permission conf file.
+// WriteFP writes a FilePermission to the configured store.
 func (c *Configuration) WriteFP(fp *FilePermission) error {
-	return c.write(c.filePermissionFileName(), []string{fp.File, fp.UserID, fp.Role.RoleID, fp.Assignment.Format(time.RFC3339), fp.Expiration.Format(time.RFC3339)})
+	return c.Apply(Mutation{FP: fp})
 }
-
-func (c *Configuration) write(file string, entry []string) error {
-	if _, err := os.Stat(file); err == nil {
-		lock := fslock.New(file)
-		if err := lock.TryLock(); err != nil {
-			return err
-		}
-		defer lock.Unlock()
-	}
-
-	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	w := csv.NewWriter(f)
-	if err := w.Write(entry); err != nil {
-		return err
-	}
-	w.Flush()
-	if err := w.Error(); err != nil {
-		return err
-	}
-	return nil
-}
-
-// parsing logic for User, FilePermission and Role
-
-type parseRecord func([]string) (interface{}, string, error)
-
-func parseUser(record []string) (interface{}, string, error) {
-	createdTime, err := time.Parse(time.RFC3339, record[6])
-	if err != nil {
-		return User{}, "", err
-	}
-	u := User{record[0], record[1], record[2], record[3], record[4], record[5], createdTime, record[7]}
-	return u, u.Email, nil
-}
-
-func parseRoles(record []string) (interface{}, string, error) {
-	return Role{record[0], record[1]}, record[0], nil
-}
-
-func parseFilePermission(record []string) (interface{}, string, error) {
-	assignment, err := time.Parse(time.RFC3339, record[3])
-	if err != nil {
-		return FilePermission{}, "", err
-	}
-	expiration, err := time.Parse(time.RFC3339, record[4])
-	if err != nil {
-		return FilePermission{}, "", err
-	}
-	role := RoleTable[record[2]]
-	return FilePermission{record[0], record[1], role, assignment, expiration}, record[1], nil
-}
-
-// table insertion logic handlers
-
-type tableInsert func(string, interface{})
-
-func userTableInsert(key string, val interface{}) {
-	if u, ok := val.(User); ok {
-		UserTable[key] = u
-	}
-}
-
-func roleTableInsert(key string, val interface{}) {
-	if r, ok := val.(Role); ok {
-		RoleTable[key] = r
-	}
-}
-
-func filePermissionTableInsert(key string, val interface{}) {
-	if fp, ok := val.(FilePermission); ok {
-		if fpMap := FilePermissionTable[key]; fpMap == nil {
-			FilePermissionTable[key] = make(map[string][]FilePermission)
-		}
-		if fps := FilePermissionTable[key][fp.File]; fps == nil {
-			FilePermissionTable[key][fp.File] = []FilePermission{fp}
-		} else {
-			fps := FilePermissionTable[key][fp.File]
-			fps = append(fps, fp)
-			FilePermissionTable[key][fp.File] = fps
-		}
-	}
-}
-
-// UserTable is a map of user email to User
-var UserTable = make(map[string]User)
-
-// FilePermissionTable is a map of UserID to a map of File to FilePermission
-var FilePermissionTable = make(map[string]map[string][]FilePermission)
-
-// RoleTable is a map of RoleID to Role
-var RoleTable = make(map[string]Role)
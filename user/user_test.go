@@ -5,16 +5,16 @@ import (
 )
 
 func TestParseUser(t *testing.T) {
-	_, err := NewConfig("file://./config/sample")
+	d, err := Open("file://./config/sample")
 	if err != nil {
 		t.Error(err)
-		t.Fail()
+		t.FailNow()
 	}
-	if len(UserTable) != 1 {
-		t.Error("UserTable should have exactly 1 entry")
+	if d.UserCount() != 1 {
+		t.Error("directory should have exactly 1 user")
 		t.Fail()
 	}
-	u := UserTable["test@openspock.org"]
+	u, _ := d.User("test@openspock.org")
 	if &u == nil {
 		t.Error("User can't be nil")
 		t.Fail()
@@ -24,7 +24,7 @@ func TestParseUser(t *testing.T) {
 		t.Error("user email invalid " + u.Email)
 		t.Fail()
 	}
-	fp := FilePermissionTable[u.UserID]
+	fp := d.snapshot().fps[u.UserID]
 	for k, v := range fp {
 		if k != "./filepermission.conf" {
 			t.Error("file name incorrect - " + k)